@@ -0,0 +1,707 @@
+package vm
+
+import (
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The kinds of operand an instruction can take, which are parsed (and
+// validated) differently. Addresses take up Profile.AddressWidth bytes,
+// and everything else a single byte, see Profile.width.
+type operand int
+
+const (
+	regOperand operand = iota
+	addrOperand
+	immOperand
+	// A forward distance in bytes from the end of the instruction
+	offsetOperand
+	// A signed distance in bytes from the end of the instruction
+	relOperand
+	// A byte of data, for .byte, which is never an instruction operand
+	byteOperand
+)
+
+func (o operand) String() string {
+	switch o {
+	case regOperand:
+		return "register"
+	case addrOperand:
+		return "address"
+	case offsetOperand:
+		return "offset"
+	case relOperand:
+		return "signed offset"
+	case byteOperand:
+		return "byte"
+	default:
+		return "immediate"
+	}
+}
+
+type instruction struct {
+	mnemonic string
+	opcode   byte
+	operands []operand
+}
+
+// accessesMemory reports whether the instruction's address operand
+// refers to data, rather than to another instruction
+func (in instruction) accessesMemory() bool {
+	return in.opcode == Load || in.opcode == Store
+}
+
+// Every instruction that compute understands, in opcode order
+var instructions = []instruction{
+	{"load", Load, []operand{regOperand, addrOperand}},
+	{"store", Store, []operand{regOperand, addrOperand}},
+	{"add", Add, []operand{regOperand, regOperand}},
+	{"sub", Sub, []operand{regOperand, regOperand}},
+	{"addi", Addi, []operand{regOperand, immOperand}},
+	{"subi", Subi, []operand{regOperand, immOperand}},
+	{"jump", Jump, []operand{addrOperand}},
+	{"beqz", Beqz, []operand{regOperand, offsetOperand}},
+	{"mul", Mul, []operand{regOperand, regOperand}},
+	{"div", Div, []operand{regOperand, regOperand}},
+	{"mod", Mod, []operand{regOperand, regOperand}},
+	{"and", And, []operand{regOperand, regOperand}},
+	{"or", Or, []operand{regOperand, regOperand}},
+	{"xor", Xor, []operand{regOperand, regOperand}},
+	{"not", Not, []operand{regOperand}},
+	{"shl", Shl, []operand{regOperand, regOperand}},
+	{"shr", Shr, []operand{regOperand, regOperand}},
+	{"push", Push, []operand{regOperand}},
+	{"pop", Pop, []operand{regOperand}},
+	{"call", Call, []operand{addrOperand}},
+	{"ret", Ret, nil},
+	{"cmp", Cmp, []operand{regOperand, regOperand}},
+	{"beq", Beq, []operand{relOperand}},
+	{"bne", Bne, []operand{relOperand}},
+	{"blt", Blt, []operand{relOperand}},
+	{"bge", Bge, []operand{relOperand}},
+	{"bltu", Bltu, []operand{relOperand}},
+	{"bgeu", Bgeu, []operand{relOperand}},
+	{"ei", Ei, nil},
+	{"di", Di, nil},
+	{"iret", Iret, nil},
+	{"halt", Halt, nil},
+}
+
+var mnemonics = func() map[string]instruction {
+	m := make(map[string]instruction, len(instructions))
+	for _, in := range instructions {
+		m[in.mnemonic] = in
+	}
+	return m
+}()
+
+// parseRegister parses a register name, r1 up to r<MaxRegisters>. The
+// machine may have fewer registers than that, which is only caught when
+// the program runs.
+func parseRegister(s string) (byte, bool) {
+	s = strings.ToLower(s)
+	if !strings.HasPrefix(s, "r") {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(s[1:], 10, 8)
+	if err != nil || n < 1 || n > MaxRegisters {
+		return 0, false
+	}
+	return byte(n), true
+}
+
+// isRegisterLike reports whether s looks like a register name, valid or
+// not, so that it can't be mistaken for a label
+func isRegisterLike(s string) bool {
+	if len(s) < 2 || (s[0] != 'r' && s[0] != 'R') {
+		return false
+	}
+	for _, r := range s[1:] {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// SyntaxError describes a problem with a single token of assembly source,
+// or of a program passed to Compile. Line and Col are both 1-based. File
+// is the included file the token is in, or empty for the source being
+// assembled.
+type SyntaxError struct {
+	File  string
+	Line  int
+	Col   int
+	Token string
+	Msg   string
+}
+
+func (e *SyntaxError) Error() string {
+	pos := fmt.Sprintf("%d:%d", e.Line, e.Col)
+	if e.File != "" {
+		pos = e.File + ":" + pos
+	}
+	if e.Token == "" {
+		return fmt.Sprintf("%s: %s", pos, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s: %q", pos, e.Msg, e.Token)
+}
+
+// A token is a single whitespace (or comma) separated word of source,
+// along with where it was found.
+type token struct {
+	text string
+	file string
+	line int
+	col  int
+}
+
+func (t token) errorf(format string, args ...interface{}) *SyntaxError {
+	return &SyntaxError{File: t.file, Line: t.line, Col: t.col, Token: t.text, Msg: fmt.Sprintf(format, args...)}
+}
+
+// tokenize splits a single line of source into tokens, dropping
+// everything after a ';' comment marker. A quoted string or character
+// is a single token, separators and all.
+func tokenize(line, file string, lineNo int) []token {
+	var tokens []token
+	start := -1
+	flush := func(end int) {
+		if start >= 0 {
+			tokens = append(tokens, token{text: line[start:end], file: file, line: lineNo, col: start + 1})
+			start = -1
+		}
+	}
+
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == ';':
+			flush(i)
+			return tokens
+		case c == ' ' || c == '\t' || c == ',' || c == '\r':
+			flush(i)
+		default:
+			if start < 0 {
+				start = i
+			}
+			if c == '"' || c == '\'' {
+				quote = c
+			}
+		}
+	}
+	flush(len(line))
+	return tokens
+}
+
+// A statement is a single instruction or data directive, along with the
+// address it will be placed at
+type statement struct {
+	name token
+	in   instruction
+	args []token
+	addr int
+	size int
+	// data is the encoding of a .string, which is known straight away
+	data []byte
+}
+
+// Assembler assembles source for a particular machine Profile. The zero
+// value assembles for Profile8, without support for .include.
+type Assembler struct {
+	Profile Profile
+	// Files is where .include looks for files
+	Files fs.FS
+}
+
+// Assemble the given assembly source to machine code for Profile8. See
+// Assembler.Assemble.
+func Assemble(src string) ([]byte, error) {
+	return Assembler{}.Assemble(src)
+}
+
+// AssembleImage assembles a memory image for Profile8. See
+// Assembler.AssembleImage.
+func AssembleImage(src string) ([]byte, error) {
+	return Assembler{}.AssembleImage(src)
+}
+
+// AssembleObject assembles an object for Profile8. See
+// Assembler.AssembleObject.
+func AssembleObject(src string) (*Object, error) {
+	return Assembler{}.AssembleObject(src)
+}
+
+// Assemble the given assembly source to machine code, suitable for
+// copying into memory starting at ProgramStart.
+//
+// Each line holds at most one instruction, written as a mnemonic
+// followed by its operands, and may be preceded by any number of
+// "name:" labels. Operands may be separated by whitespace or commas,
+// numbers may be written in decimal, hex (0x), binary (0b) or as a
+// quoted character ('a'), and anything after a ';' is a comment.
+//
+// Wherever an address is expected a label may be used instead. For
+// jump and call that is the label's absolute address, and for beqz and
+// the other branches it is the distance to the label from the end of
+// the branch instruction.
+//
+// A line may also hold one of these directives:
+//
+//	.equ NAME value    define a constant, usable wherever a number is
+//	.org address       place what follows at address
+//	.byte v, ...       emit bytes
+//	.string "text"     emit a string, followed by a zero byte
+//	.include "file"    assemble another file from Files in place
+//	.entry label       start running at label, see AssembleObject
+//
+// Assemble rejects anything placed before ProgramStart, see
+// AssembleImage.
+func (a Assembler) Assemble(src string) ([]byte, error) {
+	as, err := a.parse(src)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := as.entryPoint(); err != nil {
+		return nil, err
+	}
+	return as.link(ProgramStart)
+}
+
+// AssembleImage is like Assemble, but returns a memory image starting at
+// address 0, so that .org can be used to lay out the data region as well
+// as the program. The image ends at the last byte assembled, and any
+// gaps are zero.
+func (a Assembler) AssembleImage(src string) ([]byte, error) {
+	as, err := a.parse(src)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := as.entryPoint(); err != nil {
+		return nil, err
+	}
+	return as.link(0)
+}
+
+// AssembleObject is like AssembleImage, but returns an object recording
+// just the parts of memory that were assembled, as segments. The object
+// also records the program's entry point (ProgramStart, unless the
+// source says otherwise with .entry), its symbols and the line of
+// source each address was assembled from.
+func (a Assembler) AssembleObject(src string) (*Object, error) {
+	as, err := a.parse(src)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := as.entryPoint()
+	if err != nil {
+		return nil, err
+	}
+	image, err := as.link(0)
+	if err != nil {
+		return nil, err
+	}
+
+	obj := &Object{Profile: as.p, Entry: entry}
+	stmts := append([]statement(nil), as.stmts...)
+	sort.SliceStable(stmts, func(i, j int) bool { return stmts[i].addr < stmts[j].addr })
+	for _, stmt := range stmts {
+		end := stmt.addr + stmt.size
+		if n := len(obj.Segments); n > 0 && obj.Segments[n-1].Addr+len(obj.Segments[n-1].Data) == stmt.addr {
+			last := &obj.Segments[n-1]
+			last.Data = image[last.Addr:end]
+		} else {
+			obj.Segments = append(obj.Segments, Segment{Addr: stmt.addr, Data: image[stmt.addr:end]})
+		}
+		obj.Lines = append(obj.Lines, SourceLine{Addr: stmt.addr, Size: stmt.size, File: stmt.name.file, Line: stmt.name.line})
+	}
+
+	for _, sym := range as.symbols {
+		obj.Symbols = append(obj.Symbols, sym)
+	}
+	sort.Slice(obj.Symbols, func(i, j int) bool {
+		a, b := obj.Symbols[i], obj.Symbols[j]
+		return a.Value < b.Value || a.Value == b.Value && a.Name < b.Name
+	})
+	return obj, nil
+}
+
+// assembly is the state of a single run of the assembler
+type assembly struct {
+	p       Profile
+	files   fs.FS
+	stmts   []statement
+	symbols map[string]Symbol
+	addr    int
+	// The operand of .entry, if there was one
+	entry *token
+	// The files currently being included, innermost last
+	including []string
+}
+
+// parse is the assembler's first pass: it finds every statement and
+// assigns it an address, so that labels can be used before they are
+// defined
+func (a Assembler) parse(src string) (*assembly, error) {
+	p := a.Profile.orDefault()
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+
+	as := &assembly{p: p, files: a.Files, symbols: map[string]Symbol{}, addr: ProgramStart}
+	if err := as.parse(src, ""); err != nil {
+		return nil, err
+	}
+	return as, nil
+}
+
+func (as *assembly) parse(src, file string) error {
+	for i, line := range strings.Split(src, "\n") {
+		tokens := tokenize(line, file, i+1)
+		for len(tokens) > 0 && strings.HasSuffix(tokens[0].text, ":") {
+			label := tokens[0]
+			name := strings.TrimSuffix(label.text, ":")
+			if !isIdentifier(name) {
+				return label.errorf("invalid label name")
+			}
+			if err := as.define(label, name, Symbol{Name: name, Value: as.addr, Label: true}); err != nil {
+				return err
+			}
+			tokens = tokens[1:]
+		}
+		if len(tokens) == 0 {
+			continue
+		}
+
+		name := tokens[0]
+		if strings.HasPrefix(name.text, ".") {
+			if err := as.directive(name, tokens[1:]); err != nil {
+				return err
+			}
+			continue
+		}
+
+		in, ok := mnemonics[strings.ToLower(name.text)]
+		if !ok {
+			return name.errorf("unknown instruction")
+		}
+		as.emit(statement{name: name, in: in, args: tokens[1:], size: as.p.size(in)})
+	}
+	return nil
+}
+
+func (as *assembly) define(t token, name string, sym Symbol) error {
+	if _, ok := as.symbols[name]; ok {
+		return t.errorf("symbol already defined")
+	}
+	as.symbols[name] = sym
+	return nil
+}
+
+// emit places a statement at the current address
+func (as *assembly) emit(stmt statement) {
+	stmt.addr = as.addr
+	as.stmts = append(as.stmts, stmt)
+	as.addr += stmt.size
+}
+
+func (as *assembly) directive(name token, args []token) error {
+	switch strings.ToLower(name.text) {
+	case ".equ":
+		if len(args) != 2 {
+			return name.errorf(".equ expects a name and a value")
+		}
+		if !isIdentifier(args[0].text) {
+			return args[0].errorf("invalid constant name")
+		}
+		v, err := as.constant(args[1])
+		if err != nil {
+			return err
+		}
+		return as.define(args[0], args[0].text, Symbol{Name: args[0].text, Value: v})
+
+	case ".org":
+		if len(args) != 1 {
+			return name.errorf(".org expects an address")
+		}
+		v, err := as.constant(args[0])
+		if err != nil {
+			return err
+		}
+		if v < 0 || v >= as.p.MemorySize {
+			return args[0].errorf("address out of range")
+		}
+		as.addr = v
+
+	case ".byte":
+		if len(args) == 0 {
+			return name.errorf(".byte expects at least one value")
+		}
+		as.emit(statement{name: name, args: args, size: len(args)})
+
+	case ".string":
+		if len(args) != 1 || !strings.HasPrefix(args[0].text, `"`) {
+			return name.errorf(".string expects a quoted string")
+		}
+		s, err := strconv.Unquote(args[0].text)
+		if err != nil {
+			return args[0].errorf("invalid string")
+		}
+		data := append([]byte(s), 0)
+		as.emit(statement{name: name, args: args, size: len(data), data: data})
+
+	case ".entry":
+		if len(args) != 1 {
+			return name.errorf(".entry expects a label")
+		}
+		if as.entry != nil {
+			return name.errorf("entry point already set")
+		}
+		as.entry = &args[0]
+
+	case ".include":
+		if len(args) != 1 || !strings.HasPrefix(args[0].text, `"`) {
+			return name.errorf(".include expects a quoted file name")
+		}
+		path, err := strconv.Unquote(args[0].text)
+		if err != nil {
+			return args[0].errorf("invalid file name")
+		}
+		return as.include(args[0], path)
+
+	default:
+		return name.errorf("unknown directive")
+	}
+	return nil
+}
+
+func (as *assembly) include(t token, path string) error {
+	if as.files == nil {
+		return t.errorf("no files to include from")
+	}
+	for _, f := range as.including {
+		if f == path {
+			return t.errorf("file includes itself")
+		}
+	}
+	src, err := fs.ReadFile(as.files, path)
+	if err != nil {
+		return t.errorf("cannot include: %s", err)
+	}
+
+	as.including = append(as.including, path)
+	defer func() { as.including = as.including[:len(as.including)-1] }()
+	return as.parse(string(src), path)
+}
+
+// constant evaluates the value of an .equ or .org, which can only refer
+// to symbols that have already been defined
+func (as *assembly) constant(t token) (int, error) {
+	if isIdentifier(t.text) {
+		sym, ok := as.symbols[t.text]
+		if !ok {
+			return 0, t.errorf("undefined symbol (constants must be defined before they are used)")
+		}
+		return sym.Value, nil
+	}
+	n, err := number(t)
+	if err != nil {
+		return 0, t.errorf("expected number")
+	}
+	return n, nil
+}
+
+// entryPoint returns the address given by .entry, which may be a label
+// defined after it, or ProgramStart if there wasn't one. The entry point
+// can't be in the data region, since an entry of 0 means ProgramStart
+// (see Options.Entry).
+func (as *assembly) entryPoint() (int, error) {
+	if as.entry == nil {
+		return ProgramStart, nil
+	}
+	entry, err := parseOperand(as.p, *as.entry, addrOperand, 0, as.symbols)
+	if err != nil {
+		return 0, err
+	}
+	if entry < ProgramStart {
+		return 0, as.entry.errorf("entry point %d is in the data region, before %d", entry, ProgramStart)
+	}
+	return entry, nil
+}
+
+// link is the assembler's second pass, which encodes every statement
+// now that all the symbols are known. It returns memory from base up to
+// the end of the last statement.
+func (as *assembly) link(base int) ([]byte, error) {
+	end := base
+	for _, stmt := range as.stmts {
+		if stmt.addr < base {
+			return nil, stmt.name.errorf("placed at %d, before the program starts at %d", stmt.addr, base)
+		}
+		if stmt.addr+stmt.size > as.p.MemorySize {
+			return nil, &SyntaxError{
+				File: stmt.name.file,
+				Line: stmt.name.line,
+				Col:  1,
+				Msg:  fmt.Sprintf("program does not fit in memory (ends at %d)", stmt.addr+stmt.size),
+			}
+		}
+		if stmt.addr+stmt.size > end {
+			end = stmt.addr + stmt.size
+		}
+	}
+
+	image := make([]byte, end-base)
+	used := make([]bool, end-base)
+	for _, stmt := range as.stmts {
+		encoded, err := as.encode(stmt)
+		if err != nil {
+			return nil, err
+		}
+		for i, b := range encoded {
+			addr := stmt.addr + i - base
+			if used[addr] {
+				return nil, stmt.name.errorf("overlaps with something already at address %d", stmt.addr+i)
+			}
+			used[addr], image[addr] = true, b
+		}
+	}
+	return image, nil
+}
+
+func (as *assembly) encode(stmt statement) ([]byte, error) {
+	if stmt.data != nil {
+		return stmt.data, nil
+	}
+	if stmt.in.mnemonic == "" {
+		// .byte
+		data := make([]byte, len(stmt.args))
+		for i, t := range stmt.args {
+			v, err := parseOperand(as.p, t, byteOperand, 0, as.symbols)
+			if err != nil {
+				return nil, err
+			}
+			data[i] = byte(v)
+		}
+		return data, nil
+	}
+
+	in, args := stmt.in, stmt.args
+	if len(args) != len(in.operands) {
+		end := stmt.name
+		if len(args) > len(in.operands) {
+			end = args[len(in.operands)]
+		}
+		return nil, end.errorf("%s expects %d operand(s), got %d", in.mnemonic, len(in.operands), len(args))
+	}
+
+	mc := []byte{in.opcode}
+	for i, kind := range in.operands {
+		v, err := parseOperand(as.p, args[i], kind, stmt.addr+stmt.size, as.symbols)
+		if err != nil {
+			return nil, err
+		}
+		mc = as.p.encode(mc, kind, v)
+	}
+	return mc, nil
+}
+
+// parseOperand parses a single operand of the given kind. next is the
+// address immediately after the instruction, which relative offsets
+// are measured from.
+func parseOperand(p Profile, t token, kind operand, next int, symbols map[string]Symbol) (int, error) {
+	if kind == regOperand {
+		r, ok := parseRegister(t.text)
+		if !ok {
+			return 0, t.errorf("expected register")
+		}
+		return int(r), nil
+	}
+
+	var v int
+	if isIdentifier(t.text) {
+		sym, ok := symbols[t.text]
+		if !ok {
+			return 0, t.errorf("undefined symbol")
+		}
+		v = sym.Value
+
+		// Branching to a label means branching by however far away
+		// it is
+		if sym.Label && (kind == offsetOperand || kind == relOperand) {
+			v -= next
+			if kind == relOperand && (v < -128 || v > 127) {
+				return 0, t.errorf("label is %d bytes away, which is out of range for a signed offset", v)
+			}
+			if kind == offsetOperand && (v < 0 || v > 0xff) {
+				return 0, t.errorf("label is %d bytes away, which is out of range for a forward offset", v)
+			}
+		}
+	} else {
+		n, err := number(t)
+		if err != nil {
+			return 0, t.errorf("expected %s", kind)
+		}
+		v = n
+	}
+
+	switch kind {
+	case relOperand:
+		if v < -128 || v > 127 {
+			return 0, t.errorf("%s out of range", kind)
+		}
+		return int(byte(int8(v))), nil
+	case byteOperand:
+		// Data can be written either way
+		if v < -128 || v > 0xff {
+			return 0, t.errorf("%s out of range", kind)
+		}
+		return int(byte(v)), nil
+	}
+	// Everything else is unsigned, and as wide as the operand
+	if v < 0 || v > 1<<(8*p.width(kind))-1 {
+		return 0, t.errorf("%s out of range", kind)
+	}
+	return v, nil
+}
+
+// number parses a numeric literal: decimal, hex (0x), binary (0b) or a
+// single quoted character
+func number(t token) (int, error) {
+	if strings.HasPrefix(t.text, "'") {
+		s, err := strconv.Unquote(t.text)
+		if err != nil || len(s) != 1 {
+			return 0, fmt.Errorf("invalid character %s", t.text)
+		}
+		return int(s[0]), nil
+	}
+	n, err := strconv.ParseInt(t.text, 0, 32)
+	return int(n), err
+}
+
+// isIdentifier reports whether s is a valid label name: a letter or
+// underscore followed by letters, digits or underscores. Anything that
+// looks like a register name is reserved.
+func isIdentifier(s string) bool {
+	if s == "" || isRegisterLike(s) {
+		return false
+	}
+	for i, r := range s {
+		letter := r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+		digit := r >= '0' && r <= '9'
+		if !letter && !(digit && i > 0) {
+			return false
+		}
+	}
+	return true
+}
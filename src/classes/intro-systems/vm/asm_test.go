@@ -0,0 +1,258 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestAssemble(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		asm  string
+		want []byte
+	}{
+		{"Empty", "", []byte{}},
+		{"Load", "load r1 1", []byte{Load, 0x01, 0x01}},
+		{"Store", "store r2 0", []byte{Store, 0x02, 0x00}},
+		{"Add", "add r1 r2", []byte{Add, 0x01, 0x02}},
+		{"HighRegisters", "add r8 r16", []byte{Add, 0x08, 0x10}},
+		{"Sub", "sub r2 r1", []byte{Sub, 0x02, 0x01}},
+		{"Addi", "addi r1 0x10", []byte{Addi, 0x01, 0x10}},
+		{"Subi", "subi r1 0b101", []byte{Subi, 0x01, 0x05}},
+		{"Jump", "jump 255", []byte{Jump, 0xff}},
+		{"Beqz", "beqz r1 3", []byte{Beqz, 0x01, 0x03}},
+		{"Mul", "mul r1 r2", []byte{Mul, 0x01, 0x02}},
+		{"Not", "not r3", []byte{Not, 0x03}},
+		{"Cmp", "cmp r1 r2", []byte{Cmp, 0x01, 0x02}},
+		{"BranchBackwards", "bne -2", []byte{Bne, 0xfe}},
+		{"BranchLabel", "top: halt\nblt top", []byte{Halt, Blt, 0xfd}},
+		{"Halt", "halt", []byte{Halt}},
+		{"Commas", "add r1, r2", []byte{Add, 0x01, 0x02}},
+		{"CaseInsensitive", "LOAD R1 1", []byte{Load, 0x01, 0x01}},
+		{"Char", "addi r1 'a'", []byte{Addi, 0x01, 'a'}},
+		{"Equ", ".equ OUT 0\n.equ n 5\naddi r1 n\nstore r1 OUT", []byte{Addi, 0x01, 0x05, Store, 0x01, 0x00}},
+		{"EquOfEqu", ".equ a 3\n.equ b a\nbne b", []byte{Bne, 0x03}},
+		{"Byte", ".byte 1, 0xff, -1, 'x', end\nend:", []byte{1, 0xff, 0xff, 'x', 0x0d}},
+		{"String", `.string "a;b, \"c\"\n"`, []byte{'a', ';', 'b', ',', ' ', '"', 'c', '"', '\n', 0}},
+		{"Org", "halt\n.org 0x0b\nhalt", []byte{Halt, 0, 0, Halt}},
+		{
+			name: "CommentsAndBlankLines",
+			asm: `
+; move input to output
+
+	load r1 1 ; first input
+store r1 0
+
+halt ; done`,
+			want: []byte{Load, 0x01, 0x01, Store, 0x01, 0x00, Halt},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Assemble(test.asm)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !bytes.Equal(got, test.want) {
+				t.Errorf("got: % x, wanted: % x", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		asm  string
+		want SyntaxError
+	}{
+		{"UnknownInstruction", "halt\n  lod r1 1", SyntaxError{Line: 2, Col: 3, Token: "lod"}},
+		{"BadRegister", "add r1 r17", SyntaxError{Line: 1, Col: 8, Token: "r17"}},
+		{"RegisterZero", "add r0 r1", SyntaxError{Line: 1, Col: 5, Token: "r0"}},
+		{"RegisterForAddress", "load r1 r2", SyntaxError{Line: 1, Col: 9, Token: "r2"}},
+		{"OutOfRange", "addi r1 256", SyntaxError{Line: 1, Col: 9, Token: "256"}},
+		{"TooFewOperands", "load r1", SyntaxError{Line: 1, Col: 1, Token: "load"}},
+		{"TooManyOperands", "halt now", SyntaxError{Line: 1, Col: 6, Token: "now"}},
+		{"UndefinedLabel", "jump nowhere", SyntaxError{Line: 1, Col: 6, Token: "nowhere"}},
+		{"DuplicateLabel", "a: halt\na: halt", SyntaxError{Line: 2, Col: 1, Token: "a:"}},
+		{"InvalidLabel", "1a: halt", SyntaxError{Line: 1, Col: 1, Token: "1a:"}},
+		{"RegisterLabel", "r1: halt", SyntaxError{Line: 1, Col: 1, Token: "r1:"}},
+		{"RegisterLikeLabel", "r99: halt", SyntaxError{Line: 1, Col: 1, Token: "r99:"}},
+		{"BackwardBeqz", "top: beqz r1 top", SyntaxError{Line: 1, Col: 14, Token: "top"}},
+		{"BranchOutOfRange", "bne 128", SyntaxError{Line: 1, Col: 5, Token: "128"}},
+		{"FarBranch", "beq far\n" + strings.Repeat("halt\n", 128) + "far: halt", SyntaxError{Line: 1, Col: 5, Token: "far"}},
+		{"UnknownDirective", ".word 1", SyntaxError{Line: 1, Col: 1, Token: ".word"}},
+		{"EquForwardReference", ".equ a b\n.equ b 1", SyntaxError{Line: 1, Col: 8, Token: "b"}},
+		{"EquRedefined", "a: halt\n.equ a 1", SyntaxError{Line: 2, Col: 6, Token: "a"}},
+		{"EquRegister", ".equ r1 1", SyntaxError{Line: 1, Col: 6, Token: "r1"}},
+		{"ByteOutOfRange", ".byte 1 256", SyntaxError{Line: 1, Col: 9, Token: "256"}},
+		{"UnquotedString", ".string hi", SyntaxError{Line: 1, Col: 1, Token: ".string"}},
+		{"OrgOutOfRange", ".org 256", SyntaxError{Line: 1, Col: 6, Token: "256"}},
+		{"OrgBeforeProgram", ".org 1\n.byte 2", SyntaxError{Line: 2, Col: 1, Token: ".byte"}},
+		{"Overlap", "halt\nhalt\n.org 8\n.byte 1 2", SyntaxError{Line: 4, Col: 1, Token: ".byte"}},
+		{"EntryUndefined", ".entry main\nhalt", SyntaxError{Line: 1, Col: 8, Token: "main"}},
+		{"EntryTwice", "a: halt\n.entry a\n.entry a", SyntaxError{Line: 3, Col: 1, Token: ".entry"}},
+		{"EntryInData", ".org 0\nstart: halt\n.entry start", SyntaxError{Line: 3, Col: 8, Token: "start"}},
+		{"IncludeWithoutFiles", `.include "lib.asm"`, SyntaxError{Line: 1, Col: 10, Token: `"lib.asm"`}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Assemble(test.asm)
+
+			var got *SyntaxError
+			if !errors.As(err, &got) {
+				t.Fatalf("expected a *SyntaxError, got: %v", err)
+			}
+			if got.Line != test.want.Line || got.Col != test.want.Col || got.Token != test.want.Token {
+				t.Errorf("got: %d:%d %q, wanted: %d:%d %q", got.Line, got.Col, got.Token, test.want.Line, test.want.Col, test.want.Token)
+			}
+		})
+	}
+}
+
+func TestAssembleLabels(t *testing.T) {
+	got, err := Assemble(`
+start:
+	load r1 1        ; 08
+loop: beqz r1 done   ; 0b
+	subi r1 1        ; 0e
+	jump loop        ; 11
+done:
+end:	store r1 0   ; 13
+	jump start       ; 16`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	want := []byte{
+		Load, 0x01, 0x01,
+		Beqz, 0x01, 0x05, // 0x0e + 5 = 0x13
+		Subi, 0x01, 0x01,
+		Jump, 0x0b,
+		Store, 0x01, 0x00,
+		Jump, 0x08,
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got: % x, wanted: % x", got, want)
+	}
+}
+
+func TestAssembleImage(t *testing.T) {
+	got, err := AssembleImage(`
+.equ OUT 0
+.org 1
+.byte 3, 4 ; inputs
+
+.org 8
+	load r1 1
+	load r2 2
+	add r1 r2
+	store r1 OUT
+	halt`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	want := []byte{
+		0, 3, 4, 0, 0, 0, 0, 0,
+		Load, 0x01, 0x01,
+		Load, 0x02, 0x02,
+		Add, 0x01, 0x02,
+		Store, 0x01, 0x00,
+		Halt,
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got: % x, wanted: % x", got, want)
+	}
+
+	memory := append(got, make([]byte, 256-len(got))...)
+	if _, err := Run(memory); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if memory[0] != 7 {
+		t.Errorf("got: %d, wanted: 7", memory[0])
+	}
+}
+
+func TestAssembleInclude(t *testing.T) {
+	files := fstest.MapFS{
+		"consts.asm": {Data: []byte(".equ OUT 0\n")},
+		"lib/double.asm": {Data: []byte(`.include "consts.asm"
+double:
+	add r1 r1
+	ret
+`)},
+		"loop.asm":    {Data: []byte(`.include "loop.asm"`)},
+		"nested.asm":  {Data: []byte(`.include "broken.asm"`)},
+		"broken.asm":  {Data: []byte("halt\n  lod r1 1")},
+		"missing.asm": {Data: []byte(`.include "nowhere.asm"`)},
+	}
+	a := Assembler{Files: files}
+
+	got, err := a.Assemble(`
+	load r1 1
+	call double
+	store r1 OUT
+	halt
+.include "lib/double.asm"`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := []byte{
+		Load, 0x01, 0x01,
+		Call, 0x11,
+		Store, 0x01, 0x00,
+		Halt,
+		Add, 0x01, 0x01,
+		Ret,
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got: % x, wanted: % x", got, want)
+	}
+
+	for _, test := range []struct {
+		name string
+		asm  string
+		want SyntaxError
+	}{
+		{"Recursive", `.include "loop.asm"`, SyntaxError{File: "loop.asm", Line: 1, Col: 10}},
+		{"ErrorInIncludedFile", "halt\n.include \"nested.asm\"", SyntaxError{File: "broken.asm", Line: 2, Col: 3}},
+		{"Missing", `.include "missing.asm"`, SyntaxError{File: "missing.asm", Line: 1, Col: 10}},
+		{"IncludedTwice", ".include \"consts.asm\"\n.include \"consts.asm\"", SyntaxError{File: "consts.asm", Line: 1, Col: 6}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := a.Assemble(test.asm)
+
+			var got *SyntaxError
+			if !errors.As(err, &got) {
+				t.Fatalf("expected a *SyntaxError, got: %v", err)
+			}
+			if got.File != test.want.File || got.Line != test.want.Line || got.Col != test.want.Col {
+				t.Errorf("got: %s, wanted: %s:%d:%d", got, test.want.File, test.want.Line, test.want.Col)
+			}
+		})
+	}
+}
+
+// Every opcode should be reachable from the assembler
+func TestAssembleAllOpcodes(t *testing.T) {
+	for _, op := range []byte{
+		Load, Store, Add, Sub, Addi, Subi, Jump, Beqz,
+		Mul, Div, Mod, And, Or, Xor, Not, Shl, Shr,
+		Push, Pop, Call, Ret,
+		Cmp, Beq, Bne, Blt, Bge, Bltu, Bgeu,
+		Ei, Di, Iret,
+		Halt,
+	} {
+		found := false
+		for _, in := range instructions {
+			if in.opcode == op {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("no mnemonic for opcode 0x%02x", op)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package vm
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// Policy decides which line of a set a cache evicts to make room
+type Policy int
+
+const (
+	// LRU evicts the least recently used line
+	LRU Policy = iota
+	// FIFO evicts the line that was filled longest ago
+	FIFO
+	// Random evicts any line, chosen with CacheConfig.Seed
+	Random
+)
+
+func (p Policy) String() string {
+	switch p {
+	case LRU:
+		return "lru"
+	case FIFO:
+		return "fifo"
+	case Random:
+		return "random"
+	}
+	return fmt.Sprintf("Policy(%d)", int(p))
+}
+
+// CacheConfig describes one level of a cache hierarchy. Size is the
+// capacity in bytes, split into lines of LineSize bytes, and Ways is the
+// associativity: 1 is direct mapped, and Size/LineSize is fully
+// associative.
+type CacheConfig struct {
+	Size     int
+	LineSize int
+	Ways     int
+	Policy   Policy
+	Seed     int64
+}
+
+// Validate returns an error if the cache can't be built. NewMachine
+// panics on an invalid cache, so callers taking configs from users
+// should check them first.
+func (c CacheConfig) Validate() error {
+	if c.LineSize <= 0 || c.Ways <= 0 || c.Size <= 0 || c.Size%(c.LineSize*c.Ways) != 0 {
+		return fmt.Errorf("invalid cache: %d bytes can't be split into %d way sets of %d byte lines",
+			c.Size, c.Ways, c.LineSize)
+	}
+	if c.Policy < LRU || c.Policy > Random {
+		return fmt.Errorf("invalid cache policy %s", c.Policy)
+	}
+	return nil
+}
+
+// CacheStats counts the accesses to one level of cache. Instruction
+// fetches, loads and stores are all accesses, but devices aren't cached.
+type CacheStats struct {
+	Hits      int
+	Misses    int
+	Evictions int
+}
+
+// HitRate returns the fraction of accesses that hit, or 0 if there were
+// none
+func (s CacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// cache models which lines are present, not their contents: memory is
+// always up to date, so there's nothing to write back
+type cache struct {
+	config CacheConfig
+	sets   [][]cacheLine
+	rand   *rand.Rand
+	clock  int
+	stats  CacheStats
+}
+
+type cacheLine struct {
+	valid  bool
+	tag    int
+	used   int // when the line was last accessed
+	filled int // when the line was brought into the cache
+}
+
+func newCache(config CacheConfig) *cache {
+	sets := make([][]cacheLine, config.Size/(config.LineSize*config.Ways))
+	for i := range sets {
+		sets[i] = make([]cacheLine, config.Ways)
+	}
+	return &cache{config: config, sets: sets, rand: rand.New(rand.NewSource(config.Seed))}
+}
+
+// access looks up the line containing addr, filling it on a miss, and
+// reports whether it hit
+func (c *cache) access(addr int) bool {
+	c.clock++
+	block := addr / c.config.LineSize
+	set, tag := c.sets[block%len(c.sets)], block/len(c.sets)
+
+	for i := range set {
+		if set[i].valid && set[i].tag == tag {
+			set[i].used = c.clock
+			c.stats.Hits++
+			return true
+		}
+	}
+
+	c.stats.Misses++
+	victim := c.victim(set)
+	if set[victim].valid {
+		c.stats.Evictions++
+	}
+	set[victim] = cacheLine{valid: true, tag: tag, used: c.clock, filled: c.clock}
+	return false
+}
+
+// victim picks the line in set to replace, preferring an empty one
+func (c *cache) victim(set []cacheLine) int {
+	for i := range set {
+		if !set[i].valid {
+			return i
+		}
+	}
+	if c.config.Policy == Random {
+		return c.rand.Intn(len(set))
+	}
+
+	victim := 0
+	for i := range set {
+		if c.config.Policy == LRU && set[i].used < set[victim].used ||
+			c.config.Policy == FIFO && set[i].filled < set[victim].filled {
+			victim = i
+		}
+	}
+	return victim
+}
+
+// touch runs the n bytes of memory from addr through the cache
+// hierarchy, starting at level. Each line that misses is fetched from
+// the level below.
+func (m *Machine) touch(level, addr, n int) {
+	if level >= len(m.caches) {
+		return
+	}
+	c := m.caches[level]
+	size := c.config.LineSize
+	for line := addr - addr%size; line < addr+n; line += size {
+		if !c.access(line) {
+			m.touch(level+1, line, size)
+		}
+	}
+}
+
+// CacheStats returns the statistics for each level of cache, starting
+// with the one closest to the CPU
+func (m *Machine) CacheStats() []CacheStats {
+	if len(m.caches) == 0 {
+		return nil
+	}
+	stats := make([]CacheStats, len(m.caches))
+	for i, c := range m.caches {
+		stats[i] = c.stats
+	}
+	return stats
+}
@@ -0,0 +1,104 @@
+package vm
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCachePolicies(t *testing.T) {
+	// A single set of two lines. Touching 0 again before bringing in 32
+	// makes 0 the most recently used, but it's still the first in.
+	accesses := []int{0, 16, 0, 32, 0}
+	for _, test := range []struct {
+		policy Policy
+		want   CacheStats
+	}{
+		{LRU, CacheStats{Hits: 2, Misses: 3, Evictions: 1}},
+		{FIFO, CacheStats{Hits: 1, Misses: 4, Evictions: 2}},
+	} {
+		t.Run(test.policy.String(), func(t *testing.T) {
+			c := newCache(CacheConfig{Size: 32, LineSize: 16, Ways: 2, Policy: test.policy})
+			for _, addr := range accesses {
+				c.access(addr)
+			}
+			if c.stats != test.want {
+				t.Errorf("got: %+v, wanted: %+v", c.stats, test.want)
+			}
+		})
+	}
+}
+
+func TestCacheDirectMapped(t *testing.T) {
+	c := newCache(CacheConfig{Size: 64, LineSize: 16, Ways: 1})
+	// 0 and 64 map to the same set, so keep evicting each other, while
+	// 17 shares a line with 16
+	for _, addr := range []int{0, 64, 0, 64, 16, 17} {
+		c.access(addr)
+	}
+	want := CacheStats{Hits: 1, Misses: 5, Evictions: 3}
+	if c.stats != want {
+		t.Errorf("got: %+v, wanted: %+v", c.stats, want)
+	}
+}
+
+func TestCacheRandom(t *testing.T) {
+	run := func() CacheStats {
+		c := newCache(CacheConfig{Size: 64, LineSize: 8, Ways: 8, Policy: Random, Seed: 1})
+		for i := 0; i < 1000; i++ {
+			c.access((i * 24) % 256)
+		}
+		return c.stats
+	}
+	if a, b := run(), run(); a != b {
+		t.Errorf("the same seed gave different results: %+v and %+v", a, b)
+	}
+}
+
+func TestCacheHierarchy(t *testing.T) {
+	mc, err := Assemble(sumToN)
+	if err != nil {
+		t.Fatalf("failed to assemble: %s", err)
+	}
+	memory := make([]byte, 256)
+	copy(memory[ProgramStart:], mc)
+	memory[1] = 20
+
+	opts := Options{Caches: []CacheConfig{
+		{Size: 16, LineSize: 4, Ways: 1},
+		{Size: 128, LineSize: 16, Ways: 4},
+	}}
+	result, err := RunContext(context.Background(), memory, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if memory[0] != 210 {
+		t.Fatalf("got output %d, wanted 210", memory[0])
+	}
+
+	if len(result.Caches) != 2 {
+		t.Fatalf("got stats for %d caches, wanted 2", len(result.Caches))
+	}
+	l1, l2 := result.Caches[0], result.Caches[1]
+	// The loop is small, so after the first time round it's nearly all
+	// hits
+	if l1.HitRate() < 0.9 {
+		t.Errorf("got L1 hit rate %.2f: %+v", l1.HitRate(), l1)
+	}
+	// L2 only sees L1's misses
+	if l2.Hits+l2.Misses != l1.Misses {
+		t.Errorf("L2 had %d accesses, but L1 missed %d times", l2.Hits+l2.Misses, l1.Misses)
+	}
+}
+
+func TestCacheValidation(t *testing.T) {
+	for _, c := range []CacheConfig{
+		{Size: 0, LineSize: 4, Ways: 1},
+		{Size: 64, LineSize: 0, Ways: 1},
+		{Size: 64, LineSize: 16, Ways: 3},
+		{Size: 64, LineSize: 16, Ways: 1, Policy: Random + 1},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", c)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"strings"
+)
+
+func build(args []string, stderr io.Writer) error {
+	flags := flag.NewFlagSet("build", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	out := flags.String("o", "", "write the object to `file` (default: the program with a .vmo extension)")
+	profile := addProfileFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return &exitError{code: exitUsage, err: err}
+	}
+	if flags.NArg() != 1 || !strings.HasSuffix(flags.Arg(0), ".asm") {
+		return &exitError{code: exitUsage, err: errors.New("usage: vm build [-profile 8|16] [-o prog.vmo] prog.asm")}
+	}
+
+	path := flags.Arg(0)
+	obj, err := loadProgram(path, profile.Profile)
+	if err != nil {
+		return err
+	}
+	data, err := obj.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	if *out == "" {
+		*out = strings.TrimSuffix(path, ".asm") + ".vmo"
+	}
+	return os.WriteFile(*out, data, 0o644)
+}
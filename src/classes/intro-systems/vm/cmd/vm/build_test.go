@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuild(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	write("lib.asm", "double:\n\tadd r1 r1\n\tret")
+	prog := write("prog.asm", `
+.entry main
+.include "lib.asm"
+main:
+	load r1 1
+	call double
+	store r1 0
+	halt`)
+
+	var stderr bytes.Buffer
+	if err := build([]string{prog}, &stderr); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	obj := filepath.Join(dir, "prog.vmo")
+
+	for _, test := range []struct {
+		name   string
+		args   []string
+		stdout string
+		stderr string
+	}{
+		{"Run", []string{"-x", "4", obj}, "8\n", "halted after 6 steps"},
+		{"Pipeline", []string{"-pipeline", "-x", "4", obj}, "8\n", "halted after 6 steps"},
+		{"Trace", []string{"-trace", "text", obj}, "0\n", "double:\n     2  0x08  add r1 r1          ; " + filepath.Join(dir, "lib.asm") + ":2"},
+		{"TraceSource", []string{"-trace", "text", prog}, "0\n", "main:\n     0  0x0c  load r1 1          ; " + prog + ":5"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if err := run(test.args, strings.NewReader(""), &stdout, &stderr); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if stdout.String() != test.stdout {
+				t.Errorf("got stdout: %q, wanted: %q", stdout.String(), test.stdout)
+			}
+			if !strings.Contains(stderr.String(), test.stderr) {
+				t.Errorf("got stderr:\n%s\nwanted it to contain:\n%s", stderr.String(), test.stderr)
+			}
+		})
+	}
+
+	out := filepath.Join(dir, "other.vmo")
+	if err := build([]string{"-o", out, prog}, &stderr); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := os.Stat(out); err != nil {
+		t.Errorf("expected -o to write %s: %s", out, err)
+	}
+
+	if err := build([]string{obj}, &stderr); err == nil {
+		t.Errorf("expected building an object to be a usage error")
+	}
+	corrupt := write("corrupt.vmo", "VMO\x01")
+	if err := run([]string{corrupt}, strings.NewReader(""), &stderr, &stderr); err == nil {
+		t.Errorf("expected running a corrupt object to fail")
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ggilmore/csi/src/classes/intro-systems/vm"
+)
+
+const debugHelp = `commands:
+  s, step [n]           run the next n instructions (default 1)
+  c, continue           run until a breakpoint, watchpoint, halt or fault
+  b, break <addr>       stop before running the instruction at addr
+  d, delete <addr>      remove the breakpoint at addr
+  w, watch <addr>       stop after any write to addr
+  unwatch <addr>        remove the watchpoint on addr
+  r, regs               print the registers
+  x, mem [addr [len]]   dump len bytes of memory from addr (default: all)
+  set <addr> <value>    write value to memory at addr
+  l, list [n]           disassemble n instructions from the PC (default 10)
+  h, help               print this message
+  q, quit               exit the debugger
+addresses may be numbers or, for assembly and object files, labels`
+
+func debug(args []string) error {
+	flags := flag.NewFlagSet("debug", flag.ContinueOnError)
+	profile := addProfileFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return &exitError{code: exitUsage, err: err}
+	}
+	if flags.NArg() != 1 {
+		return &exitError{code: exitUsage, err: errors.New("usage: vm debug [-profile 8|16] prog.asm|prog.vmo|prog.bin")}
+	}
+
+	obj, err := loadProgram(flags.Arg(0), profile.Profile)
+	if err != nil {
+		return err
+	}
+	m, err := vm.LoadObject(obj, vm.Options{})
+	if err != nil {
+		return err
+	}
+
+	d := &debugger{m: m, profile: obj.Profile, obj: obj, out: os.Stdout}
+	return d.repl(os.Stdin)
+}
+
+type debugger struct {
+	m       *vm.Machine
+	profile vm.Profile
+	// obj is where the program came from, for its symbols and source
+	// lines. It may be nil.
+	obj *vm.Object
+	out io.Writer
+}
+
+func (d *debugger) repl(in io.Reader) error {
+	d.printf("%s\n", debugHelp)
+	d.printCurrent()
+
+	scanner := bufio.NewScanner(in)
+	for {
+		d.printf("(vm) ")
+		if !scanner.Scan() {
+			d.printf("\n")
+			return scanner.Err()
+		}
+		if quit := d.exec(strings.Fields(scanner.Text())); quit {
+			return nil
+		}
+	}
+}
+
+// exec runs a single debugger command, reporting whether it was quit
+func (d *debugger) exec(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "s", "step":
+		n := 1
+		if len(args) > 0 {
+			var err error
+			if n, err = strconv.Atoi(args[0]); err != nil {
+				d.printf("invalid count %q\n", args[0])
+				return false
+			}
+		}
+		for i := 0; i < n; i++ {
+			if err := d.m.Step(); err != nil {
+				d.printf("%s\n", err)
+				break
+			}
+		}
+		d.printCurrent()
+
+	case "c", "continue":
+		if err := d.m.Continue(context.Background()); err != nil {
+			d.printf("%s\n", err)
+		} else {
+			d.printf("halted after %d steps\n", d.m.Steps())
+		}
+		d.printCurrent()
+
+	case "b", "break", "d", "delete", "w", "watch", "unwatch":
+		addr, ok := d.parseAddr(args)
+		if !ok {
+			return false
+		}
+		switch cmd {
+		case "b", "break":
+			d.m.SetBreakpoint(addr)
+		case "d", "delete":
+			d.m.ClearBreakpoint(addr)
+		case "w", "watch":
+			d.m.Watch(addr)
+		default:
+			d.m.Unwatch(addr)
+		}
+		d.printf("breakpoints: %v, watchpoints: %v\n", d.m.Breakpoints(), d.m.Watchpoints())
+
+	case "r", "regs":
+		d.printf("pc=0x%02x sp=0x%02x flags=%s", d.m.PC(), d.m.SP(), d.m.Flags())
+		if d.m.InterruptsEnabled() {
+			d.printf(" ie")
+		}
+		for r, v := range d.m.Registers()[1:] {
+			d.printf(" r%d=%d", r+1, v)
+		}
+		d.printf(" steps=%d (%s)\n", d.m.Steps(), d.m.Result().Reason)
+
+	case "x", "mem":
+		memory := d.m.Memory()
+		start, length := 0, len(memory)
+		if len(args) > 0 {
+			var ok bool
+			if start, ok = d.parseAddr(args[:1]); !ok {
+				return false
+			}
+			length = 16
+		}
+		if len(args) > 1 {
+			n, err := strconv.ParseUint(args[1], 0, 16)
+			if err != nil {
+				d.printf("invalid length %q\n", args[1])
+				return false
+			}
+			length = int(n)
+		}
+		end := start + length
+		if end > len(memory) {
+			end = len(memory)
+		}
+		hexDump(d.out, memory[start:end], start)
+
+	case "set":
+		addr, ok := d.parseAddr(args)
+		if !ok {
+			return false
+		}
+		if len(args) < 2 {
+			d.printf("usage: set <addr> <value>\n")
+			return false
+		}
+		v, err := strconv.ParseUint(args[1], 0, 8)
+		if err != nil {
+			d.printf("invalid value %q\n", args[1])
+			return false
+		}
+		d.m.Memory()[addr] = byte(v)
+
+	case "l", "list":
+		n := 10
+		if len(args) > 0 {
+			var err error
+			if n, err = strconv.Atoi(args[0]); err != nil || n < 0 {
+				d.printf("invalid count %q\n", args[0])
+				return false
+			}
+		}
+		d.printf("%s", vm.DisassembleN(d.profile, d.m.Memory(), d.m.PC(), n))
+
+	case "h", "help":
+		d.printf("%s\n", debugHelp)
+
+	case "q", "quit":
+		return true
+
+	default:
+		d.printf("unknown command %q, try help\n", cmd)
+	}
+	return false
+}
+
+// parseAddr parses the first argument as a memory address, or the name
+// of a label
+func (d *debugger) parseAddr(args []string) (int, bool) {
+	if len(args) == 0 {
+		d.printf("missing address\n")
+		return 0, false
+	}
+	if d.obj != nil {
+		if sym, ok := d.obj.Lookup(args[0]); ok && sym.Label {
+			return sym.Value, true
+		}
+	}
+	addr, err := strconv.ParseUint(args[0], 0, 64)
+	if err != nil || addr >= uint64(len(d.m.Memory())) {
+		d.printf("invalid address %q\n", args[0])
+		return 0, false
+	}
+	return int(addr), true
+}
+
+// printCurrent prints the instruction at the PC, which will run next
+func (d *debugger) printCurrent() {
+	memory, pc := d.m.Memory(), d.m.PC()
+	if pc < 0 || pc >= len(memory) {
+		d.printf("pc=0x%02x is out of bounds\n", pc)
+		return
+	}
+
+	if d.obj != nil {
+		where := d.obj.SymbolAt(pc)
+		if l, ok := d.obj.LineAt(pc); ok {
+			where = strings.TrimSpace(where + " at " + l.String())
+		}
+		if where != "" {
+			d.printf("%s\n", where)
+		}
+	}
+
+	d.printf("%s", vm.DisassembleN(d.profile, memory, pc, 1))
+}
+
+func (d *debugger) printf(format string, args ...interface{}) {
+	fmt.Fprintf(d.out, format, args...)
+}
+
+// hexDump writes memory as rows of 16 bytes, labelling each row with the
+// address of its first byte (offset by base)
+func hexDump(w io.Writer, memory []byte, base int) {
+	for i := 0; i < len(memory); i += 16 {
+		end := i + 16
+		if end > len(memory) {
+			end = len(memory)
+		}
+		fmt.Fprintf(w, "0x%02x  % x\n", base+i, memory[i:end])
+	}
+}
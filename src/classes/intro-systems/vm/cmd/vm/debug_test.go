@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/ggilmore/csi/src/classes/intro-systems/vm"
+)
+
+func TestDebugger(t *testing.T) {
+	mc, err := vm.Assemble(`
+	load r1 1
+	addi r1 2
+	store r1 0
+	halt`)
+	if err != nil {
+		t.Fatalf("failed to assemble: %s", err)
+	}
+	memory := make([]byte, 256)
+	copy(memory[vm.ProgramStart:], mc)
+
+	var out bytes.Buffer
+	d := &debugger{m: vm.NewMachine(memory, vm.Options{}), out: &out}
+
+	script := strings.Join([]string{
+		"set 1 40",
+		"break 0x0e",
+		"continue",
+		"regs",
+		"watch 0",
+		"continue",
+		"mem 0 2",
+		"continue",
+		"step",
+		"quit",
+		"regs", // never reached
+	}, "\n")
+	if err := d.repl(strings.NewReader(script)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, want := range []string{
+		"breakpoint at memory location 14\n0x0e  02 01 00  store r1 0",
+		"pc=0x0e sp=0x100 flags=---- r1=42 r2=0 r3=0 r4=0 r5=0 r6=0 r7=0 r8=0 steps=2 (paused)",
+		"watchpoint on address 0: 0 -> 42",
+		"0x00  2a 28\n",
+		"halted after 4 steps",
+		"machine has halted",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestDebuggerSymbols(t *testing.T) {
+	obj, err := vm.AssembleObject(`
+	load r1 1
+loop:
+	beqz r1 done
+	subi r1 1
+	jump loop
+done:
+	halt`)
+	if err != nil {
+		t.Fatalf("failed to assemble: %s", err)
+	}
+	m, err := vm.LoadObject(obj, vm.Options{})
+	if err != nil {
+		t.Fatalf("failed to load: %s", err)
+	}
+
+	var out bytes.Buffer
+	d := &debugger{m: m, obj: obj, out: &out}
+	script := strings.Join([]string{
+		"set 1 2",
+		"break done",
+		"break nowhere",
+		"continue",
+		"step",
+		"regs",
+	}, "\n")
+	if err := d.repl(strings.NewReader(script)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, want := range []string{
+		"at line 2\n0x08  01 01 01  load r1 1",
+		"breakpoints: [19]",
+		`invalid address "nowhere"`,
+		"breakpoint at memory location 19\ndone at line 8\n0x13  ff",
+		"(halted)",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestDebuggerList(t *testing.T) {
+	memory := vm.Profile16.NewMemory()
+	copy(memory[vm.ProgramStart:], []byte{vm.Halt})
+
+	var out bytes.Buffer
+	d := &debugger{m: vm.NewMachine(memory, vm.Options{Profile: vm.Profile16}), profile: vm.Profile16, out: &out}
+	for _, test := range []struct {
+		cmd   string
+		lines int
+	}{
+		{"list", 10},
+		{"list 3", 3},
+		{"step", 1},
+	} {
+		out.Reset()
+		d.exec(strings.Fields(test.cmd))
+		if got := strings.Count(out.String(), "\n"); got != test.lines {
+			t.Errorf("%s printed %d lines, wanted %d:\n%s", test.cmd, got, test.lines, out.String())
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// Command vm works with programs for the vm package.
+//
+// Usage:
+//
+//	vm run [flags] prog.asm|prog.vmo|prog.bin    run a program and print its output
+//	vm debug prog.asm|prog.vmo|prog.bin          step through a program interactively
+//	vm build [-o prog.vmo] prog.asm              assemble a program to an object file
+//
+// Programs are either assembly source (.asm), an object file (.vmo)
+// written by build, or a raw memory image (.bin) which is loaded
+// starting at address 0. Assembly may .include other files relative to
+// its own directory, and .org its data into the data region. Each
+// command takes a -profile flag to select 8 bit (the default) or 16 bit
+// addressing, which object files record for themselves. With -io, run
+// maps a console and an input stream (see vm.StandardDevices) to stdout
+// and stdin.
+//
+// The exit status is 0 if the program halted, 1 if it could not be
+// loaded, 2 for bad usage, 3 if it faulted and 4 if it ran out of steps.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ggilmore/csi/src/classes/intro-systems/vm"
+)
+
+const (
+	exitLoad   = 1
+	exitUsage  = 2
+	exitFault  = 3
+	exitBudget = 4
+)
+
+// exitError is an error that should cause the command to exit with a
+// particular status
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: vm run [flags] prog.asm|prog.vmo|prog.bin")
+	fmt.Fprintln(os.Stderr, "       vm debug prog.asm|prog.vmo|prog.bin")
+	fmt.Fprintln(os.Stderr, "       vm build [-o prog.vmo] prog.asm")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "run":
+		err = run(os.Args[2:], os.Stdin, os.Stdout, os.Stderr)
+	case "debug":
+		err = debug(os.Args[2:])
+	case "build":
+		err = build(os.Args[2:], os.Stderr)
+	default:
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "vm: %s\n", err)
+
+		var exitErr *exitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.code)
+		}
+		os.Exit(exitLoad)
+	}
+}
+
+// profileFlag selects a vm.Profile by its address width in bits
+type profileFlag struct {
+	vm.Profile
+}
+
+func (p *profileFlag) String() string {
+	return fmt.Sprint(8 * p.orDefault().AddressWidth)
+}
+
+func (p *profileFlag) Set(s string) error {
+	switch s {
+	case "8":
+		p.Profile = vm.Profile8
+	case "16":
+		p.Profile = vm.Profile16
+	default:
+		return errors.New("must be 8 or 16")
+	}
+	return nil
+}
+
+func (p *profileFlag) orDefault() vm.Profile {
+	if p.Profile == (vm.Profile{}) {
+		return vm.Profile8
+	}
+	return p.Profile
+}
+
+func addProfileFlag(flags *flag.FlagSet) *profileFlag {
+	p := &profileFlag{Profile: vm.Profile8}
+	flags.Var(p, "profile", "address width in bits, `8 or 16`")
+	return p
+}
+
+// loadProgram reads the program at path, assembling it unless it's a
+// .bin memory image or a .vmo object. Memory images are loaded at
+// address 0 and run from ProgramStart, like the output of the assembler
+// without .entry.
+func loadProgram(path string, profile vm.Profile) (*vm.Object, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch filepath.Ext(path) {
+	case ".bin":
+		if len(src) > profile.MemorySize {
+			return nil, fmt.Errorf("%s: image is %d bytes, but memory is only %d", path, len(src), profile.MemorySize)
+		}
+		segment := vm.Segment{Addr: 0, Data: src}
+		return &vm.Object{Profile: profile, Entry: vm.ProgramStart, Segments: []vm.Segment{segment}}, nil
+	case ".vmo":
+		obj := &vm.Object{}
+		if err := obj.UnmarshalBinary(src); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return obj, nil
+	}
+
+	dir := filepath.Dir(path)
+	obj, err := vm.Assembler{Profile: profile, Files: os.DirFS(dir)}.AssembleObject(string(src))
+	if err != nil {
+		// Errors in included files already say which file they're in
+		var syntaxErr *vm.SyntaxError
+		if errors.As(err, &syntaxErr) && syntaxErr.File != "" {
+			syntaxErr.File = filepath.Join(dir, syntaxErr.File)
+			return nil, err
+		}
+		return nil, fmt.Errorf("%s:%w", path, err)
+	}
+
+	// Name files the way the user would to open them
+	for i, l := range obj.Lines {
+		if l.File == "" {
+			obj.Lines[i].File = path
+		} else {
+			obj.Lines[i].File = filepath.Join(dir, l.File)
+		}
+	}
+	return obj, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/ggilmore/csi/src/classes/intro-systems/vm"
+)
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("run", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var (
+		x        = flags.Uint("x", 0, "input byte written to address 1")
+		y        = flags.Uint("y", 0, "input byte written to address 2")
+		trace    = flags.String("trace", "", "trace every instruction to stderr, as `text or json`")
+		dump     = flags.Bool("dump", false, "print all of memory once the program stops")
+		stats    = flags.Bool("stats", false, "print performance counters once the program stops")
+		maxSteps = flags.Int("max-steps", 1000000, "stop after this many instructions (0 for no limit)")
+		timeout  = flags.Duration("timeout", 0, "stop after this long (0 for no limit)")
+		devices  = flags.Bool("io", false, "map the console, input stream and cycle counter to stdout and stdin")
+		protect  = flags.Bool("protect", false, "fault on writes to code and on executing data or the stack")
+		pipeline = flags.Bool("pipeline", false, "run on the five stage pipeline rather than the interpreter")
+		forward  = flags.Bool("forwarding", false, "forward results between pipeline stages (with -pipeline)")
+		predict  = flags.Bool("predict", false, "predict branches not taken (with -pipeline)")
+		profile  = addProfileFlag(flags)
+		caches   cacheFlag
+	)
+	flags.Var(&caches, "cache", "add a level of cache, as `size:line:ways[:lru|fifo|random]` (repeatable)")
+	if err := flags.Parse(args); err != nil {
+		return &exitError{code: exitUsage, err: err}
+	}
+	if flags.NArg() != 1 {
+		return &exitError{code: exitUsage, err: errors.New("usage: vm run [flags] prog.asm|prog.vmo|prog.bin")}
+	}
+	if *x > 0xff || *y > 0xff {
+		return &exitError{code: exitUsage, err: errors.New("inputs must fit in a byte")}
+	}
+
+	opts := vm.Options{MaxSteps: *maxSteps, Caches: caches}
+	switch *trace {
+	case "":
+	case "text":
+		opts.Tracer = vm.NewTextTracer(stderr)
+	case "json":
+		opts.Tracer = vm.NewJSONTracer(stderr)
+	default:
+		return &exitError{code: exitUsage, err: fmt.Errorf("unknown trace format %q", *trace)}
+	}
+	if *pipeline && opts.Tracer != nil {
+		return &exitError{code: exitUsage, err: errors.New("the pipeline can't be traced")}
+	}
+
+	obj, err := loadProgram(flags.Arg(0), profile.Profile)
+	if err != nil {
+		return err
+	}
+	memory := obj.Profile.NewMemory()
+	if err := obj.Load(memory); err != nil {
+		return err
+	}
+	opts.Profile, opts.Entry, opts.Object = obj.Profile, obj.Entry, obj
+
+	// Raw images may already have their inputs filled in, so only
+	// overwrite them when asked to
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "x":
+			memory[1] = byte(*x)
+		case "y":
+			memory[2] = byte(*y)
+		}
+	})
+
+	if *devices {
+		opts.Devices = vm.StandardDevices(bufio.NewReader(stdin), stdout)
+	}
+	if *protect {
+		opts.Regions = vm.DefaultRegions(len(memory), 0)
+	}
+
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	var (
+		result        vm.Result
+		pipelineStats vm.PipelineStats
+	)
+	if *pipeline {
+		popts := vm.PipelineOptions{Options: opts, Forwarding: *forward, PredictNotTaken: *predict}
+		result, pipelineStats, err = vm.RunPipelined(ctx, memory, popts)
+	} else {
+		result, err = vm.RunContext(ctx, memory, opts)
+	}
+
+	fmt.Fprintf(stdout, "%d\n", memory[0])
+	if *dump {
+		hexDump(stdout, memory, 0)
+	}
+	fmt.Fprintf(stderr, "%s after %d steps\n", result.Reason, result.Steps)
+	if *stats {
+		c := result.Counters
+		fmt.Fprintf(stderr, "cycles=%d instructions=%d loads=%d stores=%d taken-branches=%d\n",
+			c.Cycles, c.Instructions, c.Loads, c.Stores, c.TakenBranches)
+		for i, c := range result.Caches {
+			fmt.Fprintf(stderr, "L%d hits=%d misses=%d evictions=%d hit-rate=%.1f%%\n",
+				i+1, c.Hits, c.Misses, c.Evictions, 100*c.HitRate())
+		}
+		if *pipeline {
+			p := pipelineStats
+			fmt.Fprintf(stderr, "pipeline cycles=%d data-stalls=%d control-stalls=%d flushes=%d\n",
+				p.Cycles, p.DataStalls, p.ControlStalls, p.Flushes)
+		}
+	}
+
+	switch result.Reason {
+	case vm.Faulted:
+		return &exitError{code: exitFault, err: err}
+	case vm.BudgetExhausted:
+		return &exitError{code: exitBudget, err: err}
+	}
+	return err
+}
+
+// cacheFlag builds up a cache hierarchy, a level at a time
+type cacheFlag []vm.CacheConfig
+
+func (c *cacheFlag) String() string {
+	var levels []string
+	for _, l := range *c {
+		levels = append(levels, fmt.Sprintf("%d:%d:%d:%s", l.Size, l.LineSize, l.Ways, l.Policy))
+	}
+	return strings.Join(levels, ",")
+}
+
+func (c *cacheFlag) Set(s string) error {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 && len(parts) != 4 {
+		return errors.New("must be size:line:ways or size:line:ways:policy")
+	}
+
+	var config vm.CacheConfig
+	for i, p := range []*int{&config.Size, &config.LineSize, &config.Ways} {
+		n, err := strconv.Atoi(parts[i])
+		if err != nil {
+			return fmt.Errorf("invalid number %q", parts[i])
+		}
+		*p = n
+	}
+	if len(parts) == 4 {
+		switch parts[3] {
+		case "lru":
+			config.Policy = vm.LRU
+		case "fifo":
+			config.Policy = vm.FIFO
+		case "random":
+			config.Policy = vm.Random
+		default:
+			return fmt.Errorf("unknown policy %q", parts[3])
+		}
+	}
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	*c = append(*c, config)
+	return nil
+}
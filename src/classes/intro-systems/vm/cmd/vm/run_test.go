@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	add := write("add.asm", `
+	load r1 1
+	load r2 2
+	add r1 r2
+	store r1 0
+	halt`)
+	loop := write("loop.asm", "loop: jump loop")
+	fault := write("fault.bin", "\x00\x05\x00\x00\x00\x00\x00\x00\x42")
+	image := write("image.bin", "\x00\x05\x00\x00\x00\x00\x00\x00\x01\x01\x01\x02\x01\x00\xff")
+	selfModifying := write("self.asm", "store r1 8\nhalt")
+	echo := write("echo.asm", `
+loop:
+	load r1 5
+	beqz r1 done
+	load r1 4
+	store r1 3
+	jump loop
+done:
+	halt`)
+	broken := write("broken.asm", "load r1")
+	write("sum.asm", "sum:\n\tadd r1 r2\n\tret")
+	data := write("data.asm", `
+.org 1
+.byte 4, 6
+.org 8
+	load r1 1
+	load r2 2
+	call sum
+	store r1 0
+	halt
+.include "sum.asm"`)
+	// 100 increments is 300 bytes of code, too much for 8 bit addresses
+	long := write("long.asm", "load r1 1\n"+strings.Repeat("addi r1 1\n", 100)+"store r1 0\nhalt")
+
+	for _, test := range []struct {
+		name   string
+		args   []string
+		code   int
+		stdout string
+		stderr string
+	}{
+		{"Add", []string{"-x", "2", "-y", "3", add}, 0, "5\n", "halted after 5 steps"},
+		{"Trace", []string{"-trace", "text", "-x", "2", "-y", "3", add}, 0, "5\n", "add r1 r2          r1=5 (was 2)"},
+		{"JSON", []string{"-trace", "json", add}, 0, "0\n", `"mnemonic":"halt"`},
+		{"Dump", []string{"-dump", "-x", "9", add}, 0, "9\n0x00  09 09 00", ""},
+		{"Stats", []string{"-stats", add}, 0, "0\n", "cycles=11 instructions=5 loads=2 stores=1 taken-branches=0"},
+		{"Cache", []string{"-stats", "-cache", "16:4:1", "-cache", "64:8:2:fifo", add}, 0, "0\n", "L2 hits=3 misses=3 evictions=0 hit-rate=50.0%"},
+		{"BadCache", []string{"-cache", "16:4:3", add}, exitUsage, "", ""},
+		{"Pipeline", []string{"-pipeline", "-forwarding", "-stats", "-x", "2", "-y", "3", add}, 0, "5\n", "pipeline cycles=10 data-stalls=1"},
+		{"PipelineTrace", []string{"-pipeline", "-trace", "text", add}, exitUsage, "", ""},
+		{"Image", []string{image}, 0, "5\n", ""},
+		{"Data", []string{data}, 0, "10\n", "halted after 7 steps"},
+		{"DataOverride", []string{"-y", "1", data}, 0, "5\n", ""},
+		{"ImageOverride", []string{"-x", "7", image}, 0, "7\n", ""},
+		{"Fault", []string{fault}, exitFault, "0\n", "faulted after 0 steps"},
+		{"Protect", []string{"-protect", selfModifying}, exitFault, "0\n", "faulted after 0 steps"},
+		{"Unprotected", []string{selfModifying}, 0, "0\n", "halted after 2 steps"},
+		{"IO", []string{"-io", echo}, 0, "hi\n0\n", "halted after 18 steps"},
+		{"Budget", []string{"-max-steps", "10", loop}, exitBudget, "0\n", "budget exhausted after 10 steps"},
+		{"Profile16", []string{"-profile", "16", "-x", "1", long}, 0, "101\n", "halted after 103 steps"},
+		{"TooLongFor8", []string{long}, exitLoad, "", ""},
+		{"BadProfile", []string{"-profile", "32", add}, exitUsage, "", ""},
+		{"AssemblyError", []string{broken}, exitLoad, "", ""},
+		{"BadInput", []string{"-x", "256", add}, exitUsage, "", ""},
+		{"NoProgram", nil, exitUsage, "", ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			err := run(test.args, strings.NewReader("hi\n"), &stdout, &stderr)
+
+			code := 0
+			if err != nil {
+				code = exitLoad
+				var exitErr *exitError
+				if errors.As(err, &exitErr) {
+					code = exitErr.code
+				}
+			}
+			if code != test.code {
+				t.Errorf("got exit code %d, wanted %d (err: %v)", code, test.code, err)
+			}
+			if !strings.HasPrefix(stdout.String(), test.stdout) {
+				t.Errorf("got stdout:\n%s\nwanted it to start with:\n%s", stdout.String(), test.stdout)
+			}
+			if !strings.Contains(stderr.String(), test.stderr) {
+				t.Errorf("got stderr:\n%s\nwanted it to contain:\n%s", stderr.String(), test.stderr)
+			}
+		})
+	}
+}
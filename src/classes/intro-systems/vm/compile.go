@@ -0,0 +1,495 @@
+package vm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Compile translates a program in a tiny high level language to vm
+// assembly, ready for Assemble. For example, summing the numbers up to
+// the first input:
+//
+//	n = x
+//	sum = 0
+//	while n {
+//		sum = sum + n
+//		n = n - 1
+//	}
+//	out = sum
+//
+// A program is a sequence of statements, each one of:
+//
+//	name = expr
+//	if expr { ... } else { ... }    (the else is optional)
+//	while expr { ... }
+//
+// where an expression is built from numbers (0 to 255), variables,
+// parentheses, + and -, all wrapping around like the machine does, and
+// a condition is true when it's not zero. Statements may be separated by
+// newlines or semicolons, and anything after a # is a comment.
+//
+// The names out, x and y refer to the output and the two inputs, at
+// addresses 0, 1 and 2. Any other variable must be assigned before it's
+// used. Variables, and the temporaries that complicated expressions
+// spill to, are given a byte each at the bottom of the stack, which
+// compiled programs don't otherwise use. That keeps them out of the way
+// of the devices mapped in the data region (see StandardDevices), and
+// writable under DefaultRegions, but limits a program to
+// DefaultStackSize of them.
+func Compile(src string) (string, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return "", err
+	}
+
+	p := &parser{tokens: tokens, vars: map[string]string{}}
+	for name, addr := range inputOutput {
+		p.vars[name] = addr
+	}
+	body, err := p.program()
+	if err != nil {
+		return "", err
+	}
+
+	c := &compiler{lines: strings.Split(src, "\n")}
+	c.block(body)
+	c.emit("halt")
+
+	if n := len(p.declared) + c.temps; n > DefaultStackSize {
+		return "", fmt.Errorf("program needs %d variables and temporaries, but only %d fit on the stack", n, DefaultStackSize)
+	} else if n > 0 {
+		fmt.Fprintf(&c.out, ".org %d\n", variablesStart)
+	}
+	for _, name := range p.declared {
+		fmt.Fprintf(&c.out, "%s: .byte 0\n", p.vars[name])
+	}
+	for i := 1; i <= c.temps; i++ {
+		fmt.Fprintf(&c.out, "%s: .byte 0\n", spill(i))
+	}
+	return c.out.String(), nil
+}
+
+// variablesStart is the address of the first variable, at the bottom of
+// the default stack of a Profile8 machine
+const variablesStart = 256 - DefaultStackSize
+
+// The variables every program starts with, and their addresses
+var inputOutput = map[string]string{"out": "0", "x": "1", "y": "2"}
+
+// variableLabel returns the label of the byte a variable is stored in.
+// The prefix keeps it clear of register names and the compiler's own
+// labels.
+func variableLabel(name string) string {
+	return "var_" + name
+}
+
+// spill returns the label of the byte the nth temporary is stored in
+func spill(n int) string {
+	return fmt.Sprintf("_spill%d", n)
+}
+
+var keywords = map[string]bool{"if": true, "else": true, "while": true}
+
+// lex splits a program into tokens. Newlines are kept, as ";", since
+// they can end a statement.
+func lex(src string) ([]token, error) {
+	var tokens []token
+	for i, line := range strings.Split(src, "\n") {
+		if j := strings.IndexByte(line, '#'); j >= 0 {
+			line = line[:j]
+		}
+
+		for col := 0; col < len(line); {
+			c := line[col]
+			start := col
+			switch {
+			case c == ' ' || c == '\t' || c == '\r':
+				col++
+				continue
+			case isDigit(c):
+				for col < len(line) && isDigit(line[col]) {
+					col++
+				}
+			case isLetter(c):
+				for col < len(line) && (isLetter(line[col]) || isDigit(line[col])) {
+					col++
+				}
+			case strings.IndexByte("=+-(){};", c) >= 0:
+				col++
+			default:
+				t := token{text: string(c), line: i + 1, col: col + 1}
+				return nil, t.errorf("unexpected character")
+			}
+			tokens = append(tokens, token{text: line[start:col], line: i + 1, col: start + 1})
+		}
+		tokens = append(tokens, token{text: ";", line: i + 1, col: len(line) + 1})
+	}
+	return tokens, nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// The syntax tree. Expressions are numbers, variables or binary
+// operations, and statements are assignments, ifs or whiles.
+type (
+	numberExpr struct {
+		v int
+	}
+	varExpr struct {
+		name string
+		// The operand to load or store the variable with
+		addr string
+	}
+	binaryExpr struct {
+		op          token
+		left, right interface{}
+	}
+
+	assignStmt struct {
+		target varExpr
+		value  interface{}
+		line   int
+	}
+	ifStmt struct {
+		cond           interface{}
+		then, els      []interface{}
+		line, elseLine int
+	}
+	whileStmt struct {
+		cond interface{}
+		body []interface{}
+		line int
+	}
+)
+
+// String returns the operand to load or store the variable with, noting
+// which variable it is if that's not obvious from the operand
+func (v varExpr) String() string {
+	if v.addr == variableLabel(v.name) {
+		return v.addr
+	}
+	return v.addr + " ; " + v.name
+}
+
+// parser is a recursive descent parser for the language Compile accepts
+type parser struct {
+	tokens []token
+	pos    int
+	// The address of every variable assigned so far, and the names of
+	// the ones the program declared, in order
+	vars     map[string]string
+	declared []string
+}
+
+func (p *parser) peek() token {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	// Report running out of program at the end of the last line
+	end := token{line: 1, col: 1}
+	if len(p.tokens) > 0 {
+		last := p.tokens[len(p.tokens)-1]
+		end = token{line: last.line, col: last.col}
+	}
+	return end
+}
+
+func (p *parser) next() token {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *parser) expect(text string) (token, error) {
+	t := p.next()
+	if t.text != text {
+		if t.text == "" {
+			return t, t.errorf("expected %q, but the program ended", text)
+		}
+		return t, t.errorf("expected %q", text)
+	}
+	return t, nil
+}
+
+// skipSeparators skips over any number of statement separators
+func (p *parser) skipSeparators() {
+	for p.peek().text == ";" {
+		p.pos++
+	}
+}
+
+func (p *parser) program() ([]interface{}, error) {
+	var body []interface{}
+	for p.skipSeparators(); p.pos < len(p.tokens); p.skipSeparators() {
+		s, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, s)
+	}
+	return body, nil
+}
+
+func (p *parser) block() ([]interface{}, error) {
+	if _, err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var body []interface{}
+	for p.skipSeparators(); p.peek().text != "}"; p.skipSeparators() {
+		if p.pos >= len(p.tokens) {
+			return nil, p.peek().errorf("expected \"}\", but the program ended")
+		}
+		s, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, s)
+	}
+	p.pos++
+	return body, nil
+}
+
+func (p *parser) statement() (interface{}, error) {
+	t := p.next()
+	switch t.text {
+	case "if":
+		cond, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		then, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		s := ifStmt{cond: cond, then: then, line: t.line}
+		if p.peek().text == "else" {
+			s.elseLine = p.next().line
+			if s.els, err = p.block(); err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+
+	case "while":
+		cond, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		body, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		return whileStmt{cond: cond, body: body, line: t.line}, nil
+	}
+
+	if !isLetter(t.text[0]) || keywords[t.text] {
+		return nil, t.errorf("expected a statement")
+	}
+	if _, err := p.expect("="); err != nil {
+		return nil, err
+	}
+	value, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+
+	// The variable only exists once it's been assigned, so that x = x
+	// is an error for a new x
+	addr, ok := p.vars[t.text]
+	if !ok {
+		addr = variableLabel(t.text)
+		p.vars[t.text] = addr
+		p.declared = append(p.declared, t.text)
+	}
+	return assignStmt{target: varExpr{name: t.text, addr: addr}, value: value, line: t.line}, nil
+}
+
+func (p *parser) expr() (interface{}, error) {
+	left, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().text == "+" || p.peek().text == "-" {
+		op := p.next()
+		right, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) term() (interface{}, error) {
+	t := p.next()
+	switch {
+	case t.text == "(":
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return e, nil
+
+	case t.text != "" && isDigit(t.text[0]):
+		n, err := strconv.Atoi(t.text)
+		if err != nil || n > 0xff {
+			return nil, t.errorf("number out of range")
+		}
+		return numberExpr{v: n}, nil
+
+	case t.text != "" && isLetter(t.text[0]) && !keywords[t.text]:
+		addr, ok := p.vars[t.text]
+		if !ok {
+			return nil, t.errorf("variable used before it's assigned")
+		}
+		return varExpr{name: t.text, addr: addr}, nil
+	}
+
+	if t.text == "" || t.text == ";" {
+		return nil, t.errorf("expected an expression, but the line ended")
+	}
+	return nil, t.errorf("expected an expression")
+}
+
+// compiler generates assembly from the syntax tree. Every expression is
+// evaluated into r1, using r2 for the right hand side of + and -. When
+// that side isn't a number or variable it's evaluated first and spilled
+// to a temporary.
+type compiler struct {
+	out      strings.Builder
+	lines    []string
+	lastLine int
+	labels   int
+	// The number of temporaries in use, and the most that have been
+	// in use at once
+	spilled, temps int
+}
+
+func (c *compiler) emit(format string, args ...interface{}) {
+	fmt.Fprintf(&c.out, "\t"+format+"\n", args...)
+}
+
+// source writes a line of the program as a comment, to show what the
+// assembly that follows it was compiled from
+func (c *compiler) source(line int) {
+	if line == c.lastLine {
+		return
+	}
+	c.lastLine = line
+	fmt.Fprintf(&c.out, "; %d: %s\n", line, strings.TrimSpace(c.lines[line-1]))
+}
+
+func (c *compiler) label(name string) {
+	fmt.Fprintf(&c.out, "%s:\n", name)
+}
+
+// newLabels returns unique label names with the given prefixes, which
+// start with an underscore so they can't clash with anything else
+func (c *compiler) newLabels(prefixes ...string) []string {
+	c.labels++
+	names := make([]string, len(prefixes))
+	for i, p := range prefixes {
+		names[i] = fmt.Sprintf("_%s%d", p, c.labels)
+	}
+	return names
+}
+
+func (c *compiler) block(body []interface{}) {
+	for _, s := range body {
+		c.statement(s)
+	}
+}
+
+func (c *compiler) statement(s interface{}) {
+	switch s := s.(type) {
+	case assignStmt:
+		c.source(s.line)
+		c.expr(s.value)
+		c.emit("store r1 %s", s.target)
+
+	case ifStmt:
+		labels := c.newLabels("else", "endif")
+		c.source(s.line)
+		c.expr(s.cond)
+		if s.els == nil {
+			c.emit("beqz r1 %s", labels[1])
+			c.block(s.then)
+		} else {
+			c.emit("beqz r1 %s", labels[0])
+			c.block(s.then)
+			c.emit("jump %s", labels[1])
+			c.label(labels[0])
+			c.source(s.elseLine)
+			c.block(s.els)
+		}
+		c.label(labels[1])
+
+	case whileStmt:
+		labels := c.newLabels("while", "endwhile")
+		c.label(labels[0])
+		c.source(s.line)
+		c.expr(s.cond)
+		c.emit("beqz r1 %s", labels[1])
+		c.block(s.body)
+		c.emit("jump %s", labels[0])
+		c.label(labels[1])
+	}
+}
+
+// expr evaluates e into r1
+func (c *compiler) expr(e interface{}) {
+	switch e := e.(type) {
+	case numberExpr:
+		c.emit("sub r1 r1")
+		if e.v != 0 {
+			c.emit("addi r1 %d", e.v)
+		}
+
+	case varExpr:
+		c.emit("load r1 %s", e)
+
+	case binaryExpr:
+		op, opi := "add", "addi"
+		if e.op.text == "-" {
+			op, opi = "sub", "subi"
+		}
+
+		switch right := e.right.(type) {
+		case numberExpr:
+			c.expr(e.left)
+			if right.v != 0 {
+				c.emit("%s r1 %d", opi, right.v)
+			}
+
+		case varExpr:
+			c.expr(e.left)
+			c.emit("load r2 %s", right)
+			c.emit("%s r1 r2", op)
+
+		default:
+			// Both sides need r1, so the right is set aside while the
+			// left is evaluated
+			c.expr(right)
+			c.spilled++
+			if c.spilled > c.temps {
+				c.temps = c.spilled
+			}
+			temp := spill(c.spilled)
+			c.emit("store r1 %s", temp)
+			c.expr(e.left)
+			c.emit("load r2 %s", temp)
+			c.emit("%s r1 r2", op)
+			c.spilled--
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package vm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCompile(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		src  string
+		// f is what the program should compute
+		f func(x, y byte) byte
+	}{
+		{"Nothing", "", func(x, y byte) byte { return 0 }},
+		{"Copy", "out = x", func(x, y byte) byte { return x }},
+		{"Constant", "out = 42", func(x, y byte) byte { return 42 }},
+		{"Add", "out = x + y", func(x, y byte) byte { return x + y }},
+		{"Subtract", "out = x - y - 1", func(x, y byte) byte { return x - y - 1 }},
+		{"Spill", "out = x - (y - (x - (y + 3)))", func(x, y byte) byte { return x - (y - (x - (y + 3))) }},
+		{"Reassign", "x = x + 1; y = y + x; out = y", func(x, y byte) byte { return y + x + 1 }},
+		{
+			name: "ManyVariables",
+			src:  "a = x; b = a + 1; c = b + 1; d = c + 1; e = d + 1; f = e + 1; g = f + y\nout = g + a",
+			f:    func(x, y byte) byte { return x + 5 + y + x },
+		},
+		{
+			name: "NestedSpills",
+			src:  "a = 1; b = 2\nout = (x + (a + (y - (b + 1)))) - (y - (x - (a + 3)))",
+			f:    func(x, y byte) byte { return (x + (1 + (y - 3))) - (y - (x - 4)) },
+		},
+		{
+			name: "SumToN",
+			src: `
+n = x
+sum = 0
+while n {
+	sum = sum + n
+	n = n - 1
+}
+out = sum`,
+			f: func(x, y byte) byte {
+				var sum byte
+				for n := x; n > 0; n-- {
+					sum += n
+				}
+				return sum
+			},
+		},
+		{
+			name: "Multiply",
+			src: `
+i = x
+while i {
+	j = y
+	while j { out = out + 1; j = j - 1 }
+	i = i - 1
+}`,
+			f: func(x, y byte) byte { return x * y },
+		},
+		{
+			name: "IfElse",
+			src: `
+# out is 1 if the inputs are equal
+if x - y {
+	out = 0
+} else {
+	out = 1
+}`,
+			f: func(x, y byte) byte {
+				if x == y {
+					return 1
+				}
+				return 0
+			},
+		},
+		{"If", "out = 7\nif y { out = x }", func(x, y byte) byte {
+			if y != 0 {
+				return x
+			}
+			return 7
+		}},
+		{
+			name: "Fibonacci",
+			src: `
+a = 0; b = 1; n = x
+while n {
+	t = a + b
+	a = b
+	b = t
+	n = n - 1
+}
+out = a`,
+			f: func(x, y byte) byte {
+				var a, b byte = 0, 1
+				for n := x; n > 0; n-- {
+					a, b = b, a+b
+				}
+				return a
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			asm, err := Compile(test.src)
+			if err != nil {
+				t.Fatalf("failed to compile: %s", err)
+			}
+			mc, err := Assemble(asm)
+			if err != nil {
+				t.Fatalf("failed to assemble: %s\n%s", err, asm)
+			}
+
+			for _, in := range [][2]byte{{0, 0}, {1, 2}, {5, 3}, {10, 7}, {13, 13}, {255, 1}} {
+				memory := make([]byte, 256)
+				copy(memory[ProgramStart:], mc)
+				memory[1], memory[2] = in[0], in[1]
+				compute(memory)
+
+				if want := test.f(in[0], in[1]); memory[0] != want {
+					t.Fatalf("Expected f(%d, %d) to be %d, not %d\n%s", in[0], in[1], want, memory[0], asm)
+				}
+			}
+		})
+	}
+}
+
+// TestCompileDevices runs a compiled program with the standard devices
+// mapped, which its variables must stay clear of, and memory protection
+// on, so its variables must be writable
+func TestCompileDevices(t *testing.T) {
+	asm, err := Compile("a = x; b = y; c = a + b; d = c + c; e = d - a\nout = e + (a - a)")
+	if err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+	mc, err := Assemble(asm)
+	if err != nil {
+		t.Fatalf("failed to assemble: %s\n%s", err, asm)
+	}
+	memory := make([]byte, 256)
+	copy(memory[ProgramStart:], mc)
+	memory[1], memory[2] = 5, 3
+
+	var console bytes.Buffer
+	opts := Options{
+		MaxSteps: 1000,
+		Devices:  StandardDevices(strings.NewReader("input"), &console),
+		Regions:  DefaultRegions(len(memory), 0),
+	}
+	if _, err := RunContext(context.Background(), memory, opts); err != nil {
+		t.Fatalf("unexpected error: %s\n%s", err, asm)
+	}
+	if memory[0] != 11 {
+		t.Errorf("got %d, wanted 11\n%s", memory[0], asm)
+	}
+	if console.Len() != 0 {
+		t.Errorf("the program wrote %q to the console", console.String())
+	}
+}
+
+func TestCompileOutput(t *testing.T) {
+	got, err := Compile("n = x + (y - 1)\nif n { out = n }")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	want := `; 1: n = x + (y - 1)
+	load r1 2 ; y
+	subi r1 1
+	store r1 _spill1
+	load r1 1 ; x
+	load r2 _spill1
+	add r1 r2
+	store r1 var_n
+; 2: if n { out = n }
+	load r1 var_n
+	beqz r1 _endif1
+	load r1 var_n
+	store r1 0 ; out
+_endif1:
+	halt
+.org 240
+var_n: .byte 0
+_spill1: .byte 0
+`
+	if got != want {
+		t.Errorf("got:\n%s\nwanted:\n%s", got, want)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		src  string
+		want SyntaxError
+	}{
+		{"Undefined", "out = z", SyntaxError{Line: 1, Col: 7, Token: "z"}},
+		{"SelfReference", "n = n + 1", SyntaxError{Line: 1, Col: 5, Token: "n"}},
+		{"NumberOutOfRange", "out = 256", SyntaxError{Line: 1, Col: 7, Token: "256"}},
+		{"MissingOperand", "out = x +", SyntaxError{Line: 1, Col: 10, Token: ";"}},
+		{"MissingEquals", "out x", SyntaxError{Line: 1, Col: 5, Token: "x"}},
+		{"MissingParen", "out = (x + y", SyntaxError{Line: 1, Col: 13, Token: ";"}},
+		{"UnexpectedCharacter", "out = x * y", SyntaxError{Line: 1, Col: 9, Token: "*"}},
+		{"Keyword", "else = 1", SyntaxError{Line: 1, Col: 1, Token: "else"}},
+		{"NotAStatement", "}", SyntaxError{Line: 1, Col: 1, Token: "}"}},
+		{"MissingBrace", "if x out = 1", SyntaxError{Line: 1, Col: 6, Token: "out"}},
+		{"Unclosed", "while x {\n\tout = 1", SyntaxError{Line: 2, Col: 9}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Compile(test.src)
+
+			var got *SyntaxError
+			if !errors.As(err, &got) {
+				t.Fatalf("expected a *SyntaxError, got: %v", err)
+			}
+			if got.Line != test.want.Line || got.Col != test.want.Col || got.Token != test.want.Token {
+				t.Errorf("got: %d:%d %q (%s), wanted: %d:%d %q", got.Line, got.Col, got.Token, got, test.want.Line, test.want.Col, test.want.Token)
+			}
+		})
+	}
+
+	// Variables only get the stack's 16 bytes
+	if _, err := Compile("a=1;b=1;c=1;d=1;e=1;f=1;g=1;h=1;i=1;j=1;k=1;l=1;m=1;n=1;o=1;p=1\nout = x - (y - p)"); err == nil {
+		t.Error("expected an error compiling a program with too many variables")
+	}
+}
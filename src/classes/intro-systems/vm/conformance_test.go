@@ -0,0 +1,186 @@
+package vm
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the results in the conformance goldens")
+
+// TestConformance runs every program in testdata/conformance against the
+// golden file beside it: add.asm is checked against add.golden. A golden
+// lists the inputs to run the program with, one case per line, and what
+// it should do:
+//
+//	1 2 -> 3                     halt with 3 in the output
+//	0 0 -> fault: <error>        fault with the given error
+//	0 0 -> budget: <error>       run out of steps
+//
+// as well as these optional settings:
+//
+//	max-steps n    the step budget for each case (default 10000)
+//	profile 16     assemble and run with Profile16
+//	stretch        only run when STRETCH=true
+//
+// Blank lines and lines starting with # are ignored. Programs may use
+// .include, which is relative to testdata/conformance.
+//
+// Run with -update to fill in the results from what the programs
+// actually do, so a new case can be written as just its inputs. Every
+// case is also run on each pipeline configuration, which must agree
+// with the interpreter.
+func TestConformance(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "conformance", "*.asm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no conformance programs found")
+	}
+
+	for _, path := range paths {
+		path := path
+		t.Run(strings.TrimSuffix(filepath.Base(path), ".asm"), func(t *testing.T) {
+			testConformance(t, path)
+		})
+	}
+}
+
+func testConformance(t *testing.T, path string) {
+	goldenPath := strings.TrimSuffix(path, ".asm") + ".golden"
+	data, err := os.ReadFile(goldenPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+
+	maxSteps, profile := 10000, Profile8
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0, strings.HasPrefix(fields[0], "#"):
+		case strings.Contains(line, "->"), isConformanceCase(fields):
+		case fields[0] == "max-steps" && len(fields) == 2:
+			if maxSteps, err = strconv.Atoi(fields[1]); err != nil {
+				t.Fatalf("%s:%d: invalid max-steps %q", goldenPath, i+1, fields[1])
+			}
+		case line == "profile 16":
+			profile = Profile16
+		case line == "stretch":
+			if os.Getenv("STRETCH") != "true" {
+				t.Skip("stretch goal, run with STRETCH=true to include it")
+			}
+		default:
+			t.Fatalf("%s:%d: unknown setting %q", goldenPath, i+1, line)
+		}
+	}
+
+	src, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := Assembler{Profile: profile, Files: os.DirFS(filepath.Dir(path))}
+	obj, err := a.AssembleObject(string(src))
+	if err != nil {
+		t.Fatalf("failed to assemble %s: %s", path, err)
+	}
+
+	cases := 0
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		inputs, want := line, ""
+		arrow := strings.Index(line, "->")
+		hasWant := arrow >= 0
+		if hasWant {
+			inputs, want = line[:arrow], line[arrow+len("->"):]
+		}
+		fields := strings.Fields(inputs)
+		if !isConformanceCase(fields) {
+			if hasWant {
+				t.Fatalf("%s:%d: invalid case %q, wanted \"x y -> result\"", goldenPath, i+1, line)
+			}
+			continue
+		}
+		cases++
+
+		x, _ := strconv.ParseUint(fields[0], 0, 8)
+		y, _ := strconv.ParseUint(fields[1], 0, 8)
+		got := runConformance(t, obj, byte(x), byte(y), maxSteps)
+
+		switch want = strings.TrimSpace(want); {
+		case *update:
+			lines[i] = fmt.Sprintf("%s %s -> %s", fields[0], fields[1], got)
+		case !hasWant:
+			t.Errorf("%s:%d: no result for f(%d, %d), run with -update to fill it in", goldenPath, i+1, x, y)
+		case got != want:
+			t.Errorf("%s:%d: f(%d, %d)\ngot:    %s\nwanted: %s", goldenPath, i+1, x, y, got, want)
+		}
+	}
+	if cases == 0 {
+		t.Errorf("%s has no cases", goldenPath)
+	}
+
+	if *update {
+		if err := os.WriteFile(goldenPath, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// isConformanceCase reports whether fields are the two inputs of a case
+func isConformanceCase(fields []string) bool {
+	if len(fields) != 2 {
+		return false
+	}
+	for _, f := range fields {
+		if _, err := strconv.ParseUint(f, 0, 8); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// runConformance runs a single case, on the interpreter and then on the
+// pipeline, and describes the outcome as it's written in a golden
+func runConformance(t *testing.T, obj *Object, x, y byte, maxSteps int) string {
+	t.Helper()
+
+	load := func() []byte {
+		memory := obj.Profile.NewMemory()
+		if err := obj.Load(memory); err != nil {
+			t.Fatal(err)
+		}
+		memory[1], memory[2] = x, y
+		return memory
+	}
+	opts := Options{MaxSteps: maxSteps, Profile: obj.Profile, Entry: obj.Entry}
+
+	want := load()
+	result, err := RunContext(context.Background(), want, opts)
+
+	for _, config := range pipelineConfigs {
+		got := load()
+		popts := PipelineOptions{Options: opts, Forwarding: config.forwarding, PredictNotTaken: config.predictNotTaken}
+		gotResult, _, gotErr := RunPipelined(context.Background(), got, popts)
+
+		if d := divergence(result, gotResult, err, gotErr, want, got); d != "" {
+			t.Errorf("%s: f(%d, %d) diverged from the interpreter at %s", config.name, x, y, d)
+		}
+	}
+
+	switch result.Reason {
+	case Faulted:
+		return "fault: " + err.Error()
+	case BudgetExhausted:
+		return "budget: " + err.Error()
+	}
+	return fmt.Sprint(want[0])
+}
@@ -0,0 +1,55 @@
+package vm
+
+// Counters are performance counters, accumulated as a machine runs
+type Counters struct {
+	// Cycles is the total cost of every instruction retired, see
+	// Options.Costs
+	Cycles int `json:"cycles"`
+	// Instructions is the number of instructions retired, including
+	// the final halt
+	Instructions int `json:"instructions"`
+	// Loads and Stores count the bytes read from and written to memory
+	// (or devices) by load, store and the stack operations. Fetching
+	// instructions isn't counted.
+	Loads  int `json:"loads"`
+	Stores int `json:"stores"`
+	// TakenBranches counts the conditional branches that were taken
+	TakenBranches int `json:"taken_branches"`
+}
+
+// DefaultCosts returns the cost in cycles of each instruction, modelled
+// loosely on a simple in-order CPU without a cache: anything that
+// touches memory costs more than register arithmetic, and division is
+// slow. Opcodes that aren't listed cost one cycle.
+func DefaultCosts() map[byte]int {
+	return map[byte]int{
+		Load:  3,
+		Store: 3,
+		Mul:   4,
+		Div:   12,
+		Mod:   12,
+		Push:  3,
+		Pop:   3,
+		Call:  4,
+		Ret:   4,
+		Iret:  5,
+	}
+}
+
+// cost returns the number of cycles op takes
+func (m *Machine) cost(op byte) int {
+	if c, ok := m.opts.Costs[op]; ok {
+		return c
+	}
+	return 1
+}
+
+// retire accounts for a successfully executed instruction, and lets any
+// devices that keep time know how long it took
+func (m *Machine) retire(op byte) {
+	cycles := m.cost(op)
+	m.steps++
+	m.counters.Instructions++
+	m.counters.Cycles += cycles
+	m.tick(cycles)
+}
@@ -0,0 +1,87 @@
+package vm
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCounters(t *testing.T) {
+	// Two ways of computing x * y
+	for _, test := range []struct {
+		name string
+		asm  string
+		want Counters
+	}{
+		{"Mul", `
+	load r1 1
+	load r2 2
+	mul r1 r2
+	store r1 0
+	halt`, Counters{Cycles: 3 + 3 + 4 + 3 + 1, Instructions: 5, Loads: 2, Stores: 1}},
+		{"RepeatedAddition", `
+	load r1 1
+	load r2 2
+loop:
+	beqz r2 done
+	add r3 r1
+	subi r2 1
+	jump loop
+done:
+	store r3 0
+	halt`, Counters{
+			// 4 times round the loop, then the branch out of it
+			Cycles:        3 + 3 + 4*4 + 1 + 3 + 1,
+			Instructions:  2 + 4*4 + 1 + 2,
+			Loads:         2,
+			Stores:        1,
+			TakenBranches: 1,
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			mc, err := Assemble(test.asm)
+			if err != nil {
+				t.Fatalf("failed to assemble: %s", err)
+			}
+			memory := make([]byte, 256)
+			copy(memory[ProgramStart:], mc)
+			memory[1], memory[2] = 3, 4
+
+			result, err := Run(memory)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if memory[0] != 12 {
+				t.Errorf("got output %d, wanted 12", memory[0])
+			}
+			if result.Counters != test.want {
+				t.Errorf("got: %+v, wanted: %+v", result.Counters, test.want)
+			}
+		})
+	}
+}
+
+func TestCosts(t *testing.T) {
+	mc, err := Assemble(`
+	push r1
+	call sub
+	pop r1
+	halt
+sub:
+	ret`)
+	if err != nil {
+		t.Fatalf("failed to assemble: %s", err)
+	}
+	memory := make([]byte, 256)
+	copy(memory[ProgramStart:], mc)
+
+	costs := map[byte]int{Push: 10, Pop: 10, Halt: 0}
+	result, err := RunContext(context.Background(), memory, Options{Costs: costs})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// Call and ret aren't in the table, so cost one cycle each
+	want := Counters{Cycles: 22, Instructions: 5, Loads: 2, Stores: 2}
+	if result.Counters != want {
+		t.Errorf("got: %+v, wanted: %+v", result.Counters, want)
+	}
+}
@@ -0,0 +1,208 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Device is a peripheral mapped into the machine's address space. Loads
+// and stores to the addresses it's mapped at go to the device instead of
+// memory, with offset counting from the start of the mapping.
+type Device interface {
+	Read(offset int) (byte, error)
+	Write(offset int, v byte) error
+}
+
+// Ticker is implemented by devices that need to know how much time has
+// passed. Tick is called after every instruction the machine runs,
+// with the number of cycles it took.
+type Ticker interface {
+	Tick(cycles int)
+}
+
+// Mapping places a device at the addresses from Start up to, but not
+// including, Start+Size
+type Mapping struct {
+	Start, Size int
+	Device      Device
+}
+
+// ErrDevice is returned when a device fails to handle a load or store
+type ErrDevice struct {
+	Addr int
+	PC   int
+	Err  error
+}
+
+func (e ErrDevice) Error() string {
+	return fmt.Sprintf("device at address %d: %s (at memory location %d)", e.Addr, e.Err, e.PC)
+}
+
+func (e ErrDevice) Unwrap() error {
+	return e.Err
+}
+
+// The addresses StandardDevices maps its devices at, which are the part
+// of the data region reserved for device ports
+const (
+	ConsolePort = 0x03
+	InputPort   = 0x04 // the next byte of input
+	InputStatus = 0x05 // 1 if there is more input, 0 at the end
+	CyclePort   = 0x06 // two bytes, little endian
+)
+
+// StandardDevices returns a console writing to out at ConsolePort, an
+// input stream reading from in at InputPort and a cycle counter at
+// CyclePort
+func StandardDevices(in io.Reader, out io.Writer) []Mapping {
+	return []Mapping{
+		{Start: ConsolePort, Size: 1, Device: NewConsole(out)},
+		{Start: InputPort, Size: 2, Device: NewInputStream(in)},
+		{Start: CyclePort, Size: 2, Device: &CycleCounter{}},
+	}
+}
+
+// Console is an output port: every byte stored to it is written out
+type Console struct {
+	w io.Writer
+}
+
+// NewConsole returns a console that writes to w
+func NewConsole(w io.Writer) *Console {
+	return &Console{w: w}
+}
+
+func (c *Console) Read(offset int) (byte, error) {
+	return 0, nil
+}
+
+func (c *Console) Write(offset int, v byte) error {
+	_, err := c.w.Write([]byte{v})
+	return err
+}
+
+// InputStream is an input port backed by an io.Reader. Loading from
+// offset 0 consumes and returns the next byte, or 0 at the end of input.
+// Loading from offset 1 returns 1 if there is more input and 0 if not,
+// without consuming anything.
+//
+// The stream reads a byte at a time and never more than one byte ahead
+// of the program, so wrap slow readers in a bufio.Reader if need be.
+type InputStream struct {
+	r io.Reader
+	// The byte read ahead by checking for more input, if there is one
+	peeked []byte
+}
+
+// NewInputStream returns an input stream that reads from r
+func NewInputStream(r io.Reader) *InputStream {
+	return &InputStream{r: r}
+}
+
+func (s *InputStream) Read(offset int) (byte, error) {
+	switch offset {
+	case 0:
+		if len(s.peeked) > 0 {
+			b := s.peeked[0]
+			s.peeked = nil
+			return b, nil
+		}
+		b, _, err := s.next()
+		return b, err
+	case 1:
+		if len(s.peeked) > 0 {
+			return 1, nil
+		}
+		b, ok, err := s.next()
+		if !ok {
+			return 0, err
+		}
+		s.peeked = []byte{b}
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// next reads a byte from the underlying reader, or returns false at the
+// end of input
+func (s *InputStream) next() (byte, bool, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(s.r, b[:]); errors.Is(err, io.EOF) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	return b[0], true, nil
+}
+
+func (s *InputStream) Write(offset int, v byte) error {
+	return errors.New("input stream is read only")
+}
+
+// CycleCounter counts the cycles the machine has run for. Its count is
+// read a byte at a time, least significant first, so loading offset 0
+// takes a snapshot that the higher offsets then read from. Storing to it
+// resets the count.
+type CycleCounter struct {
+	count, latched uint64
+}
+
+func (c *CycleCounter) Read(offset int) (byte, error) {
+	if offset == 0 {
+		c.latched = c.count
+	}
+	if offset >= 8 {
+		return 0, nil
+	}
+	return byte(c.latched >> (8 * offset)), nil
+}
+
+func (c *CycleCounter) Write(offset int, v byte) error {
+	c.count, c.latched = 0, 0
+	return nil
+}
+
+func (c *CycleCounter) Tick(cycles int) {
+	c.count += uint64(cycles)
+}
+
+// Count returns the number of cycles counted so far
+func (c *CycleCounter) Count() uint64 {
+	return c.count
+}
+
+// device returns the device mapped at addr, and addr's offset within it
+func (m *Machine) device(addr int) (Device, int, bool) {
+	for _, d := range m.opts.Devices {
+		if addr >= d.Start && addr < d.Start+d.Size {
+			return d.Device, addr - d.Start, true
+		}
+	}
+	return nil, 0, false
+}
+
+// read loads a byte from memory, or from a device mapped at addr, on
+// behalf of the running program
+func (m *Machine) read(addr int) (byte, error) {
+	m.counters.Loads++
+	d, offset, ok := m.device(addr)
+	if !ok {
+		m.touch(0, addr, 1)
+		return m.memory[addr], nil
+	}
+	v, err := d.Read(offset)
+	if err != nil {
+		return 0, ErrDevice{Addr: addr, PC: m.pc, Err: err}
+	}
+	return v, nil
+}
+
+// tick tells every device that keeps time that an instruction has run
+func (m *Machine) tick(cycles int) {
+	for _, d := range m.opts.Devices {
+		if t, ok := d.Device.(Ticker); ok {
+			t.Tick(cycles)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package vm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDevices(t *testing.T) {
+	// Echo the input to the console, then report how many instructions
+	// that took
+	mc, err := Assemble(`
+loop:
+	load r1 5
+	beqz r1 done
+	load r1 4
+	store r1 3
+	jump loop
+done:
+	load r1 6
+	load r2 7
+	store r1 0
+	store r2 1
+	halt`)
+	if err != nil {
+		t.Fatalf("failed to assemble: %s", err)
+	}
+	memory := make([]byte, 256)
+	copy(memory[ProgramStart:], mc)
+
+	var out bytes.Buffer
+	opts := Options{MaxSteps: 1000, Devices: StandardDevices(strings.NewReader("hello, world"), &out)}
+	if _, err := RunContext(context.Background(), memory, opts); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if out.String() != "hello, world" {
+		t.Errorf("got output %q, wanted %q", out.String(), "hello, world")
+	}
+	// 11 cycles per byte, and 4 to notice the end of input
+	if cycles := int(memory[0]) | int(memory[1])<<8; cycles != 12*11+4 {
+		t.Errorf("got %d cycles, wanted %d", cycles, 12*11+4)
+	}
+	// The mapped addresses were never written through to memory
+	if memory[ConsolePort] != 0 {
+		t.Errorf("console write reached memory: %d", memory[ConsolePort])
+	}
+}
+
+func TestCycleCounter(t *testing.T) {
+	c := &CycleCounter{}
+	c.Tick(0x1234)
+
+	lo, _ := c.Read(0)
+	c.Tick(0xff)
+	hi, _ := c.Read(1)
+	if lo != 0x34 || hi != 0x12 {
+		t.Errorf("got 0x%02x%02x, wanted the count when the low byte was read", hi, lo)
+	}
+
+	c.Write(0, 0)
+	if c.Count() != 0 {
+		t.Errorf("got %d after a reset", c.Count())
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestDeviceFault(t *testing.T) {
+	mc, err := Assemble(`
+	store r1 3
+	halt`)
+	if err != nil {
+		t.Fatalf("failed to assemble: %s", err)
+	}
+	memory := make([]byte, 256)
+	copy(memory[ProgramStart:], mc)
+
+	opts := Options{Devices: []Mapping{{Start: 3, Size: 1, Device: NewConsole(failingWriter{})}}}
+	_, err = RunContext(context.Background(), memory, opts)
+
+	var devErr ErrDevice
+	if !errors.As(err, &devErr) || devErr.Addr != 3 || devErr.PC != ProgramStart {
+		t.Fatalf("got: %v, wanted an ErrDevice at address 3", err)
+	}
+	if devErr.Unwrap().Error() != "disk full" {
+		t.Errorf("got underlying error %v", devErr.Unwrap())
+	}
+}
@@ -0,0 +1,105 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+)
+
+var opcodes = func() map[byte]instruction {
+	m := make(map[byte]instruction, len(instructions))
+	for _, in := range instructions {
+		m[in.opcode] = in
+	}
+	return m
+}()
+
+// Disassemble decodes a Profile8 memory image, see DisassembleProfile
+func Disassemble(memory []byte, start byte) string {
+	return DisassembleProfile(Profile8, memory, int(start))
+}
+
+// DisassembleProfile decodes the memory image from start to the end of
+// memory, producing one line per instruction of the form:
+//
+//	0x0b  08 01 08  beqz r1 8      ; -> 0x16
+//
+// Branch and jump targets are resolved to absolute addresses in a
+// trailing comment. Bytes that are not a known opcode (or an instruction
+// that runs off the end of memory) are emitted as a .byte line and
+// decoding carries on from the following byte.
+func DisassembleProfile(p Profile, memory []byte, start int) string {
+	return DisassembleN(p, memory, start, -1)
+}
+
+// DisassembleN decodes at most n instructions (or .byte lines) from
+// start, in the same form as DisassembleProfile, stopping early at the
+// end of memory. A negative n decodes to the end of memory.
+func DisassembleN(p Profile, memory []byte, start, n int) string {
+	p = p.orDefault()
+
+	var b strings.Builder
+	for addr := start; addr < len(memory) && n != 0; n-- {
+		op := memory[addr]
+		in, ok := opcodes[op]
+		if !ok || addr+p.size(in) > len(memory) {
+			reason := "unknown opcode"
+			if ok {
+				reason = "truncated " + in.mnemonic
+			}
+			writeLine(&b, addr, memory[addr:addr+1], fmt.Sprintf(".byte 0x%02x", op), reason)
+			addr++
+			continue
+		}
+
+		raw := memory[addr : addr+p.size(in)]
+		text, comment := format(p, in, raw, addr)
+		writeLine(&b, addr, raw, text, comment)
+		addr += p.size(in)
+	}
+	return b.String()
+}
+
+// format renders a single decoded instruction as assembly source, along
+// with an optional comment describing where it branches to
+func format(p Profile, in instruction, raw []byte, addr int) (text, comment string) {
+	next := addr + p.size(in)
+	parts := []string{in.mnemonic}
+	for i, v := range p.decode(in, raw) {
+		switch in.operands[i] {
+		case regOperand:
+			parts = append(parts, registerName(byte(v)))
+		case addrOperand:
+			parts = append(parts, fmt.Sprint(v))
+			if in.opcode == Jump || in.opcode == Call {
+				comment = fmt.Sprintf("-> 0x%02x", v)
+			}
+		case offsetOperand:
+			parts = append(parts, fmt.Sprint(v))
+			comment = fmt.Sprintf("-> 0x%02x", next+v)
+		case relOperand:
+			parts = append(parts, fmt.Sprint(int8(v)))
+			comment = fmt.Sprintf("-> 0x%02x", next+int(int8(v)))
+		default:
+			parts = append(parts, fmt.Sprint(v))
+		}
+	}
+	return strings.Join(parts, " "), comment
+}
+
+func registerName(r byte) string {
+	if r == 0 || r > MaxRegisters {
+		// Not something the assembler would produce, but still worth
+		// showing
+		return fmt.Sprintf("r?%d", r)
+	}
+	return fmt.Sprintf("r%d", r)
+}
+
+func writeLine(b *strings.Builder, addr int, raw []byte, text, comment string) {
+	line := fmt.Sprintf("0x%02x  %-9s %s", addr, fmt.Sprintf("% x", raw), text)
+	if comment != "" {
+		line = fmt.Sprintf("%-30s ; %s", line, comment)
+	}
+	b.WriteString(line)
+	b.WriteByte('\n')
+}
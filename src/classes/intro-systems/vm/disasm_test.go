@@ -0,0 +1,87 @@
+package vm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDisassemble(t *testing.T) {
+	memory := []byte{
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		Load, 0x01, 0x01,
+		Beqz, 0x01, 0x03,
+		Jump, 0x08,
+		0x42,
+		Store, 0x01, 0x00,
+		Halt,
+		Add, 0x01,
+	}
+
+	got := Disassemble(memory, ProgramStart)
+	want := strings.Join([]string{
+		"0x08  01 01 01  load r1 1",
+		"0x0b  08 01 03  beqz r1 3      ; -> 0x11",
+		"0x0e  07 08     jump 8         ; -> 0x08",
+		"0x10  42        .byte 0x42     ; unknown opcode",
+		"0x11  02 01 00  store r1 0",
+		"0x14  ff        halt",
+		"0x15  03        .byte 0x03     ; truncated add",
+		"0x16  01        .byte 0x01     ; truncated load",
+		"",
+	}, "\n")
+	if got != want {
+		t.Errorf("got:\n%s\nwanted:\n%s", got, want)
+	}
+}
+
+func TestDisassembleN(t *testing.T) {
+	memory := Profile16.NewMemory()
+	copy(memory[ProgramStart:], []byte{Load, 0x01, 0x01, 0x00, Halt})
+
+	for _, test := range []struct {
+		start, n int
+		want     string
+	}{
+		{ProgramStart, 1, "0x08  01 01 01 00 load r1 1\n"},
+		{ProgramStart, 3, "0x08  01 01 01 00 load r1 1\n0x0c  ff        halt\n0x0d  00        .byte 0x00     ; unknown opcode\n"},
+		{ProgramStart, 0, ""},
+		{0xffff, 5, "0xffff  00        .byte 0x00   ; unknown opcode\n"},
+	} {
+		if got := DisassembleN(Profile16, memory, test.start, test.n); got != test.want {
+			t.Errorf("DisassembleN(0x%02x, %d) got:\n%s\nwanted:\n%s", test.start, test.n, got, test.want)
+		}
+	}
+}
+
+// Disassembling an assembled program and assembling the result should
+// give back the same machine code
+func TestDisassembleRoundTrip(t *testing.T) {
+	for _, tests := range [][]vmTest{mainTests, stretchGoalTests, aluTests, stackTests, branchTests} {
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				mc, err := Assemble(test.asm)
+				if err != nil {
+					t.Fatalf("failed to assemble: %s", err)
+				}
+
+				memory := make([]byte, ProgramStart+len(mc))
+				copy(memory[ProgramStart:], mc)
+
+				var src []string
+				for _, line := range strings.Split(strings.TrimSpace(Disassemble(memory, ProgramStart)), "\n") {
+					// strip the address and raw bytes
+					src = append(src, line[16:])
+				}
+
+				again, err := Assemble(strings.Join(src, "\n"))
+				if err != nil {
+					t.Fatalf("failed to reassemble: %s", err)
+				}
+				if !bytes.Equal(mc, again) {
+					t.Errorf("got: % x, wanted: % x", again, mc)
+				}
+			})
+		}
+	}
+}
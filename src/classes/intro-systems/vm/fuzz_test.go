@@ -0,0 +1,80 @@
+//go:build go1.18
+// +build go1.18
+
+// Fuzz targets need Go 1.18, so they're kept apart from the other tests,
+// which still build with the Go version in go.mod
+
+package vm
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+// fuzzCaches is the cache hierarchy FuzzEngines runs with when asked to
+var fuzzCaches = []CacheConfig{
+	{Size: 16, LineSize: 4, Ways: 1},
+	{Size: 64, LineSize: 8, Ways: 2, Policy: Random, Seed: 1},
+}
+
+// FuzzEngines runs random memory images on the interpreter and on every
+// configuration of the pipeline, and checks they all agree. Each image
+// is run on Profile8 or Profile16, with or without caches. Devices,
+// protected regions and interrupts aren't fuzzed, and the image is at
+// most 256 bytes even with Profile16.
+func FuzzEngines(f *testing.F) {
+	for _, tests := range [][]vmTest{mainTests, stretchGoalTests, aluTests, stackTests, branchTests} {
+		for _, test := range tests {
+			for _, wide := range []bool{false, true} {
+				a := Assembler{Profile: Profile8}
+				if wide {
+					a.Profile = Profile16
+				}
+				mc, err := a.Assemble(test.asm)
+				if err != nil {
+					f.Fatalf("failed to assemble %s for %d byte addresses: %s", test.name, a.Profile.AddressWidth, err)
+				}
+				for i, c := range test.cases {
+					image := make([]byte, ProgramStart, ProgramStart+len(mc))
+					image[1], image[2] = c.x, c.y
+					// Try every other case with caches
+					f.Add(append(image, mc...), wide, i%2 == 1)
+				}
+			}
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, image []byte, wide, cached bool) {
+		if len(image) > 256 {
+			image = image[:256]
+		}
+		profile := Profile8
+		if wide {
+			profile = Profile16
+		}
+		load := func() []byte {
+			memory := profile.NewMemory()
+			copy(memory, image)
+			return memory
+		}
+
+		opts := Options{MaxSteps: 1000, Profile: profile}
+		if cached {
+			opts.Caches = fuzzCaches
+		}
+		want := load()
+		wantResult, wantErr := RunContext(context.Background(), want, opts)
+
+		for _, config := range pipelineConfigs {
+			got := load()
+			popts := PipelineOptions{Options: opts, Forwarding: config.forwarding, PredictNotTaken: config.predictNotTaken}
+			gotResult, _, gotErr := RunPipelined(context.Background(), got, popts)
+
+			if d := divergence(wantResult, gotResult, wantErr, gotErr, want, got); d != "" {
+				t.Fatalf("%s pipeline diverged from the interpreter with %d byte addresses and caches=%v at %s\nprogram:\n%s",
+					config.name, profile.AddressWidth, cached, d, DisassembleProfile(profile, bytes.TrimRight(image, "\x00"), ProgramStart))
+			}
+		}
+	})
+}
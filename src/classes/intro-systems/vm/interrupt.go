@@ -0,0 +1,96 @@
+package vm
+
+// InterruptSource is implemented by devices that can raise interrupts.
+// Pending reports whether the device wants to interrupt the machine, and
+// Acknowledge is called when the machine takes the interrupt.
+type InterruptSource interface {
+	Pending() bool
+	Acknowledge()
+}
+
+// Timer is a device that raises an interrupt every period cycles. Its
+// period is programmable: storing to it sets the period and restarts
+// the count, with 0 stopping the timer, and loading from it returns the
+// current period.
+type Timer struct {
+	period  int
+	elapsed int
+	pending bool
+}
+
+// NewTimer returns a timer that interrupts every period cycles, or not
+// at all until it's programmed if period is 0
+func NewTimer(period byte) *Timer {
+	return &Timer{period: int(period)}
+}
+
+func (t *Timer) Read(offset int) (byte, error) {
+	return byte(t.period), nil
+}
+
+func (t *Timer) Write(offset int, v byte) error {
+	t.period, t.elapsed = int(v), 0
+	return nil
+}
+
+func (t *Timer) Tick(cycles int) {
+	if t.period == 0 {
+		return
+	}
+	t.elapsed += cycles
+	if t.elapsed >= t.period {
+		t.elapsed %= t.period
+		t.pending = true
+	}
+}
+
+func (t *Timer) Pending() bool {
+	return t.pending
+}
+
+func (t *Timer) Acknowledge() {
+	t.pending = false
+}
+
+// interrupt delivers a pending interrupt, if there is one and the
+// machine will take it, by pushing the PC and flags and jumping to the
+// handler. Only one device is acknowledged at a time, in the order they
+// are mapped.
+func (m *Machine) interrupt() error {
+	if !m.interrupts || m.opts.InterruptVector == 0 {
+		return nil
+	}
+
+	var source InterruptSource
+	for _, d := range m.opts.Devices {
+		if s, ok := d.Device.(InterruptSource); ok && s.Pending() {
+			source = s
+			break
+		}
+	}
+	if source == nil {
+		return nil
+	}
+
+	// Check there's room for both the PC and flags before pushing
+	// either
+	if m.sp-m.profile.AddressWidth-1 < m.stackBase {
+		return ErrStackOverflow{SP: m.sp, PC: m.pc}
+	}
+	if err := m.pushAddr(m.pc); err != nil {
+		return err
+	}
+	if err := m.push(byte(m.flags)); err != nil {
+		return err
+	}
+
+	handler := 0
+	for b := 0; b < m.profile.AddressWidth; b++ {
+		handler |= int(m.memory[m.opts.InterruptVector+b]) << (8 * b)
+	}
+
+	source.Acknowledge()
+	m.interrupts = false
+	m.pc = handler
+	return nil
+}
@@ -0,0 +1,164 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// Every instruction takes one cycle, so the timer counts instructions
+var unitCosts = map[byte]int{}
+
+// testVector is where the interrupt tests keep the address of their
+// handlers, well clear of their code and devices
+const testVector = 0xd0
+
+// The main loop counts in r1 until it's preempted by the timer for the
+// third time
+const preempted = `
+	load r3 2
+	ei
+loop:
+	addi r1 1
+	jump loop
+handler:          ; at 0x11
+	addi r2 1
+	cmp r2 r3
+	beq done
+	iret
+done:
+	store r1 0
+	store r2 1
+	halt`
+
+func TestInterrupts(t *testing.T) {
+	mc, err := Assemble(preempted)
+	if err != nil {
+		t.Fatalf("failed to assemble: %s", err)
+	}
+	memory := make([]byte, 256)
+	copy(memory[ProgramStart:], mc)
+	memory[2] = 3
+	memory[testVector] = 0x11
+
+	timer := NewTimer(10)
+	opts := Options{
+		MaxSteps:        1000,
+		InterruptVector: testVector,
+		Costs:           unitCosts,
+		Devices:         []Mapping{{Start: 0xe0, Size: 1, Device: timer}},
+	}
+	result, err := RunContext(context.Background(), memory, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if memory[1] != 3 {
+		t.Errorf("got %d interrupts, wanted 3", memory[1])
+	}
+	// Each 10 cycle period is shared between the 4 instructions of the
+	// handler (except the first time) and the loop
+	if memory[0] != 4+3+3 {
+		t.Errorf("main loop ran %d times, wanted 10", memory[0])
+	}
+	if result.InterruptsEnabled {
+		t.Errorf("expected interrupts to be disabled in the handler")
+	}
+	// The final interrupt's PC and flags are still on the stack
+	if result.SP != 254 {
+		t.Errorf("got sp=%d, wanted 254", result.SP)
+	}
+}
+
+func TestIret(t *testing.T) {
+	mc, err := Assemble(`
+	load r1 1
+	load r2 2
+	ei
+	cmp r1 r2      ; sets Z
+	not r3         ; interrupted here, clearing Z in the handler
+	beq equal
+	halt
+equal:
+	store r1 0
+	halt
+handler:          ; at 0x1b
+	subi r2 1
+	store r4 0xe0  ; stop the timer
+	iret`)
+	if err != nil {
+		t.Fatalf("failed to assemble: %s", err)
+	}
+	memory := make([]byte, 256)
+	copy(memory[ProgramStart:], mc)
+	memory[1], memory[2] = 4, 4
+	memory[testVector] = 0x1b
+
+	m := NewMachine(memory, Options{InterruptVector: testVector, Costs: unitCosts, Devices: []Mapping{{Start: 0xe0, Size: 1, Device: NewTimer(4)}}})
+	if err := m.Continue(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The handler ran after cmp, and the flags it set were restored
+	if m.Registers()[2] != 3 {
+		t.Errorf("handler didn't run: %v", m.Registers())
+	}
+	if memory[0] != 4 {
+		t.Errorf("flags weren't restored by iret")
+	}
+	if !m.InterruptsEnabled() || m.SP() != 256 {
+		t.Errorf("got interrupts=%v sp=%d after iret", m.InterruptsEnabled(), m.SP())
+	}
+}
+
+func TestInterruptsDisabled(t *testing.T) {
+	mc, err := Assemble(`
+	load r1 1
+	ei
+	di
+	store r1 0xe0  ; program the timer
+	addi r1 1
+	addi r1 1
+	addi r1 1
+	store r1 0
+	halt`)
+	if err != nil {
+		t.Fatalf("failed to assemble: %s", err)
+	}
+	memory := make([]byte, 256)
+	copy(memory[ProgramStart:], mc)
+	memory[1] = 1
+
+	timer := NewTimer(0)
+	opts := Options{InterruptVector: testVector, Devices: []Mapping{{Start: 0xe0, Size: 1, Device: timer}}}
+	if _, err := RunContext(context.Background(), memory, opts); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if memory[0] != 4 {
+		t.Errorf("got %d, wanted 4", memory[0])
+	}
+	// The interrupt is still waiting for interrupts to be enabled
+	if !timer.Pending() {
+		t.Errorf("expected the timer to have fired")
+	}
+}
+
+func TestInterruptVectorValidation(t *testing.T) {
+	timer := []Mapping{{Start: 0xe0, Size: 1, Device: NewTimer(4)}}
+	for _, test := range []struct {
+		name string
+		opts Options
+	}{
+		{"DevicePorts", Options{InterruptVector: 7}},
+		{"DevicePortsWide", Options{Profile: Profile16, InterruptVector: 2}},
+		{"OnADevice", Options{InterruptVector: 0xe0, Devices: timer}},
+		{"HalfOnADevice", Options{Profile: Profile16, InterruptVector: 0xdf, Devices: timer}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			memory := test.opts.Profile.NewMemory()
+			if _, err := RunContext(context.Background(), memory, test.opts); !errors.Is(err, ErrInvalidOptions) {
+				t.Errorf("got %v, wanted an ErrInvalidOptions", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,383 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrHalted is returned when stepping a machine that has already run a
+// halt instruction
+var ErrHalted = errors.New("machine has halted")
+
+// ErrBreakpoint is returned by Continue when the machine reaches an
+// address with a breakpoint set. The instruction there has not run yet.
+type ErrBreakpoint struct {
+	PC int
+}
+
+func (e ErrBreakpoint) Error() string {
+	return fmt.Sprintf("breakpoint at memory location %d", e.PC)
+}
+
+// ErrWatchpoint is returned when an instruction writes to a watched
+// memory address. The instruction has already run.
+type ErrWatchpoint struct {
+	Addr     int
+	PC       int
+	Old, New byte
+}
+
+func (e ErrWatchpoint) Error() string {
+	return fmt.Sprintf("watchpoint on address %d: %d -> %d (written at memory location %d)", e.Addr, e.Old, e.New, e.PC)
+}
+
+// Machine is a single instance of the vm that can be run an instruction
+// at a time, for use by debuggers and other tooling. Run and RunContext
+// cover the common case of running a program to completion.
+type Machine struct {
+	memory    []byte
+	pc        int
+	registers []byte // indexed by register number, there's no r0
+	sp        int
+	stackBase int // the lowest address the stack can grow to
+	flags     Flags
+	// interrupts is set when interrupts are enabled
+	interrupts bool
+	profile    Profile
+	steps      int
+	counters   Counters
+	opts       Options
+
+	// Why the machine last stopped, and if it has halted or faulted then
+	// it won't run any more instructions
+	reason  HaltReason
+	stopped bool
+	err     error
+
+	breakpoints map[int]bool
+	watchpoints map[int]bool
+	watchHit    *ErrWatchpoint
+
+	// The permissions for each address, or nil if memory isn't
+	// protected
+	perms []Perm
+
+	caches []*cache
+
+	// The instruction currently being traced, if there's a tracer
+	event *Event
+}
+
+// ErrInvalidOptions is wrapped by the errors RunContext, RunPipelined and
+// LoadObject return when they're given options a machine can't be built
+// with
+var ErrInvalidOptions = errors.New("invalid options")
+
+// validate returns an error wrapping ErrInvalidOptions if a machine with
+// memorySize bytes of memory can't be built with opts
+func (opts Options) validate(memorySize int) error {
+	invalid := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: %s", ErrInvalidOptions, fmt.Sprintf(format, args...))
+	}
+
+	profile := opts.Profile.orDefault()
+	if err := profile.validate(); err != nil {
+		return invalid("%s", err)
+	}
+	if opts.Registers < 0 || opts.Registers > MaxRegisters {
+		return invalid("cannot have %d registers, the most is %d", opts.Registers, MaxRegisters)
+	}
+	if opts.StackSize < 0 {
+		return invalid("invalid stack size %d", opts.StackSize)
+	}
+	if v := opts.InterruptVector; v != 0 {
+		end := v + profile.AddressWidth
+		if v < 0 || end > memorySize {
+			return invalid("interrupt vector %d is out of bounds", v)
+		}
+		if v < ProgramStart && end > ConsolePort {
+			return invalid("interrupt vector %d is in the bytes reserved for device ports", v)
+		}
+		for _, d := range opts.Devices {
+			if v < d.Start+d.Size && end > d.Start {
+				return invalid("interrupt vector %d overlaps the device at address %d", v, d.Start)
+			}
+		}
+	}
+	if e := opts.Entry; e != 0 && (e < 0 || e >= memorySize) {
+		return invalid("entry point %d is out of bounds", e)
+	}
+	for _, c := range opts.Caches {
+		if err := c.Validate(); err != nil {
+			return invalid("%s", err)
+		}
+	}
+	return nil
+}
+
+// NewMachine returns a machine ready to run the program stored in memory,
+// starting at opts.Entry. Memory is modified in place as it runs.
+//
+// NewMachine panics if opts.Registers is more than MaxRegisters,
+// opts.StackSize is negative, opts.Profile or one of opts.Caches is
+// invalid, opts.InterruptVector or opts.Entry is out of bounds, or the
+// vector is somewhere devices are or may be mapped.
+func NewMachine(memory []byte, opts Options) *Machine {
+	if err := opts.validate(len(memory)); err != nil {
+		panic("vm: " + err.Error())
+	}
+
+	opts.Profile = opts.Profile.orDefault()
+	if opts.Registers == 0 {
+		opts.Registers = DefaultRegisters
+	}
+	if opts.StackSize == 0 {
+		opts.StackSize = DefaultStackSize
+	}
+	if opts.Costs == nil {
+		opts.Costs = DefaultCosts()
+	}
+	if opts.Entry == 0 {
+		opts.Entry = ProgramStart
+	}
+
+	stackBase := len(memory) - opts.StackSize
+	if stackBase < 0 {
+		stackBase = 0
+	}
+
+	caches := make([]*cache, len(opts.Caches))
+	for i, c := range opts.Caches {
+		caches[i] = newCache(c)
+	}
+
+	var perms []Perm
+	if opts.Regions != nil {
+		perms = permissions(opts.Regions, len(memory))
+	}
+
+	return &Machine{
+		memory:      memory,
+		pc:          opts.Entry,
+		registers:   make([]byte, opts.Registers+1),
+		sp:          len(memory),
+		stackBase:   stackBase,
+		profile:     opts.Profile,
+		opts:        opts,
+		reason:      Paused,
+		breakpoints: map[int]bool{},
+		watchpoints: map[int]bool{},
+		perms:       perms,
+		caches:      caches,
+	}
+}
+
+// Step runs a single instruction. Once the machine halts further calls
+// return ErrHalted, and once it faults they return the same fault.
+//
+// Breakpoints are ignored, but an ErrWatchpoint is returned if the
+// instruction wrote to a watched address.
+func (m *Machine) Step() error {
+	if m.stopped {
+		if m.err != nil {
+			return m.err
+		}
+		return ErrHalted
+	}
+	if m.opts.MaxSteps > 0 && m.steps >= m.opts.MaxSteps {
+		m.reason = BudgetExhausted
+		return ErrBudgetExhausted{PC: m.PC(), Steps: m.steps}
+	}
+	if err := m.interrupt(); err != nil {
+		m.stop(Faulted, err)
+		return err
+	}
+
+	var before []byte
+	if m.opts.Tracer != nil {
+		before = m.Registers()
+		m.event = m.newEvent()
+		m.opts.Tracer.Before(*m.event)
+	}
+
+	halted, err := m.step()
+
+	if m.event != nil {
+		m.finishEvent(m.event, before, err)
+		m.opts.Tracer.After(*m.event)
+		m.event = nil
+	}
+
+	switch {
+	case err != nil:
+		m.stop(Faulted, err)
+		return err
+	case halted:
+		m.stop(Halted, nil)
+	default:
+		m.reason = Paused
+	}
+
+	if hit := m.watchHit; hit != nil {
+		m.watchHit = nil
+		return *hit
+	}
+	return nil
+}
+
+func (m *Machine) stop(reason HaltReason, err error) {
+	m.reason = reason
+	m.stopped = true
+	m.err = err
+}
+
+// Continue runs instructions until the machine halts (returning nil),
+// faults, hits a breakpoint or watchpoint, or runs out of budget. A
+// breakpoint at the current PC is skipped, so that calling Continue
+// again after hitting one makes progress.
+func (m *Machine) Continue(ctx context.Context) error {
+	for first := true; ; first = false {
+		if err := ctx.Err(); err != nil {
+			m.reason = BudgetExhausted
+			return ErrBudgetExhausted{PC: m.PC(), Steps: m.steps, Err: err}
+		}
+		if !first && m.breakpoints[m.PC()] {
+			return ErrBreakpoint{PC: m.PC()}
+		}
+
+		if err := m.Step(); err != nil {
+			return err
+		}
+		if m.stopped {
+			return nil
+		}
+	}
+}
+
+// write stores a byte to memory, or to a device mapped at addr, on
+// behalf of the running program, noting if it hit a watchpoint
+func (m *Machine) write(addr int, v byte) error {
+	m.counters.Stores++
+	d, offset, isDevice := m.device(addr)
+	old := m.memory[addr]
+	if isDevice {
+		// There's nothing meaningful to report as the old value, and
+		// reading it could have side effects
+		old = 0
+		if err := d.Write(offset, v); err != nil {
+			return ErrDevice{Addr: addr, PC: m.pc, Err: err}
+		}
+	}
+
+	if m.watchpoints[addr] && m.watchHit == nil {
+		m.watchHit = &ErrWatchpoint{Addr: addr, PC: m.PC(), Old: old, New: v}
+	}
+	if m.event != nil {
+		m.event.Writes = append(m.event.Writes, MemoryWrite{Addr: addr, Old: old, New: v, Device: isDevice})
+	}
+	if !isDevice {
+		m.touch(0, addr, 1)
+		m.memory[addr] = v
+	}
+	return nil
+}
+
+// SetBreakpoint stops Continue before running the instruction at addr
+func (m *Machine) SetBreakpoint(addr int) {
+	m.breakpoints[addr] = true
+}
+
+// ClearBreakpoint removes a breakpoint set with SetBreakpoint
+func (m *Machine) ClearBreakpoint(addr int) {
+	delete(m.breakpoints, addr)
+}
+
+// Breakpoints returns every address with a breakpoint, in order
+func (m *Machine) Breakpoints() []int {
+	return sortedKeys(m.breakpoints)
+}
+
+// Watch stops Step and Continue after any instruction that writes to
+// addr
+func (m *Machine) Watch(addr int) {
+	m.watchpoints[addr] = true
+}
+
+// Unwatch removes a watchpoint set with Watch
+func (m *Machine) Unwatch(addr int) {
+	delete(m.watchpoints, addr)
+}
+
+// Watchpoints returns every watched address, in order
+func (m *Machine) Watchpoints() []int {
+	return sortedKeys(m.watchpoints)
+}
+
+// PC returns the address of the next instruction to run
+func (m *Machine) PC() int {
+	return m.pc
+}
+
+// SP returns the stack pointer, which is the address of the value on
+// top of the stack
+func (m *Machine) SP() int {
+	return m.sp
+}
+
+// Flags returns the condition flags
+func (m *Machine) Flags() Flags {
+	return m.flags
+}
+
+// InterruptsEnabled reports whether the machine would take an interrupt
+func (m *Machine) InterruptsEnabled() bool {
+	return m.interrupts
+}
+
+// Registers returns a copy of the register file, indexed by register
+// number (see Result)
+func (m *Machine) Registers() []byte {
+	return append([]byte(nil), m.registers...)
+}
+
+// Memory returns the machine's memory. It is not a copy, so changes
+// made to it are seen by the running program.
+func (m *Machine) Memory() []byte {
+	return m.memory
+}
+
+// Steps returns the number of instructions run so far
+func (m *Machine) Steps() int {
+	return m.steps
+}
+
+// Counters returns the performance counters so far
+func (m *Machine) Counters() Counters {
+	return m.counters
+}
+
+// Result describes the machine's current state
+func (m *Machine) Result() Result {
+	return Result{
+		PC:                m.pc,
+		SP:                m.sp,
+		Flags:             m.flags,
+		Registers:         m.Registers(),
+		Steps:             m.steps,
+		Reason:            m.reason,
+		InterruptsEnabled: m.interrupts,
+		Counters:          m.counters,
+		Caches:            m.CacheStats(),
+	}
+}
+
+func sortedKeys(set map[int]bool) []int {
+	keys := make([]int, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
@@ -0,0 +1,117 @@
+package vm
+
+import (
+	"context"
+	"testing"
+)
+
+const sumToN = `
+	load r1 1
+loop:
+	beqz r1 done
+	add r2 r1
+	subi r1 1
+	jump loop
+done:
+	store r2 0
+	halt`
+
+func newTestMachine(t *testing.T, asm string, x, y byte) *Machine {
+	t.Helper()
+
+	mc, err := Assemble(asm)
+	if err != nil {
+		t.Fatalf("failed to assemble: %s", err)
+	}
+	memory := make([]byte, 256)
+	copy(memory[ProgramStart:], mc)
+	memory[1] = x
+	memory[2] = y
+
+	return NewMachine(memory, Options{})
+}
+
+func TestMachineStep(t *testing.T) {
+	m := newTestMachine(t, sumToN, 2, 0)
+
+	for _, want := range []int{0x0b, 0x0e, 0x11, 0x14, 0x08 + 3} {
+		if err := m.Step(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if m.PC() != want {
+			t.Fatalf("got PC: 0x%02x, wanted: 0x%02x", m.PC(), want)
+		}
+	}
+	if got := m.Registers(); got[1] != 1 || got[2] != 2 {
+		t.Errorf("got registers: %v", got)
+	}
+	if m.Result().Reason != Paused {
+		t.Errorf("got reason: %s, wanted: %s", m.Result().Reason, Paused)
+	}
+
+	if err := m.Continue(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if m.Memory()[0] != 3 {
+		t.Errorf("got output: %d, wanted: 3", m.Memory()[0])
+	}
+	if err := m.Step(); err != ErrHalted {
+		t.Errorf("got: %v, wanted: %v", err, ErrHalted)
+	}
+}
+
+func TestMachineBreakpoint(t *testing.T) {
+	m := newTestMachine(t, sumToN, 3, 0)
+
+	// the add instruction, which runs once per loop iteration
+	m.SetBreakpoint(0x0e)
+
+	for i := 3; i > 0; i-- {
+		err := m.Continue(context.Background())
+		if err != (ErrBreakpoint{PC: 0x0e}) {
+			t.Fatalf("got: %v, wanted a breakpoint", err)
+		}
+		if r := m.Registers()[1]; int(r) != i {
+			t.Fatalf("got r1: %d, wanted: %d", r, i)
+		}
+	}
+
+	m.ClearBreakpoint(0x0e)
+	if len(m.Breakpoints()) != 0 {
+		t.Errorf("got breakpoints: %v", m.Breakpoints())
+	}
+	if err := m.Continue(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if m.Result().Reason != Halted {
+		t.Errorf("got reason: %s, wanted: %s", m.Result().Reason, Halted)
+	}
+}
+
+func TestMachineWatchpoint(t *testing.T) {
+	m := newTestMachine(t, sumToN, 4, 0)
+	m.Watch(0)
+
+	err := m.Continue(context.Background())
+	want := ErrWatchpoint{Addr: 0, PC: 0x16, Old: 0, New: 10}
+	if err != want {
+		t.Fatalf("got: %v, wanted: %v", err, want)
+	}
+	if m.PC() != 0x19 {
+		t.Errorf("expected the store to have run, PC is 0x%02x", m.PC())
+	}
+}
+
+func TestMachineFaultIsSticky(t *testing.T) {
+	m := NewMachine([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0x42}, Options{})
+
+	want := ErrUnknownOpcode{Op: 0x42, PC: 8}
+	for i := 0; i < 2; i++ {
+		if err := m.Step(); err != want {
+			t.Fatalf("got: %v, wanted: %v", err, want)
+		}
+	}
+	if m.Steps() != 0 {
+		t.Errorf("got steps: %d, wanted: 0", m.Steps())
+	}
+}
@@ -0,0 +1,384 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// Object is an assembled program along with what's needed to load it and
+// to debug it: which parts of memory it occupies, where it starts, and
+// which names and source lines each address came from.
+type Object struct {
+	// Profile is the machine the object was assembled for
+	Profile Profile
+	// Entry is the address of the first instruction to run. As with
+	// Options.Entry, zero means ProgramStart, and otherwise it can't be
+	// in the data region.
+	Entry    int
+	Segments []Segment
+	// Symbols are sorted by value, and then by name
+	Symbols []Symbol
+	// Lines are sorted by address
+	Lines []SourceLine
+}
+
+// Segment is a contiguous run of bytes to be loaded at Addr
+type Segment struct {
+	Addr int
+	Data []byte
+}
+
+// Symbol is a name defined in the source: either a label, whose value is
+// the address it marks, or a constant defined with .equ
+type Symbol struct {
+	Name  string
+	Value int
+	Label bool
+}
+
+// SourceLine records that the Size bytes from Addr were assembled from a
+// line of source. File is empty for the source passed to the assembler,
+// or the name of an included file.
+type SourceLine struct {
+	Addr int
+	Size int
+	File string
+	Line int
+}
+
+func (l SourceLine) String() string {
+	if l.File == "" {
+		return fmt.Sprintf("line %d", l.Line)
+	}
+	return fmt.Sprintf("%s:%d", l.File, l.Line)
+}
+
+// ErrBadObject is returned when decoding something that isn't a valid
+// object file
+var ErrBadObject = errors.New("invalid object file")
+
+// Load copies each of the object's segments into memory
+func (o *Object) Load(memory []byte) error {
+	for _, s := range o.Segments {
+		if s.Addr < 0 || s.Addr+len(s.Data) > len(memory) {
+			return fmt.Errorf("segment at %d (%d bytes) doesn't fit in %d bytes of memory", s.Addr, len(s.Data), len(memory))
+		}
+		copy(memory[s.Addr:], s.Data)
+	}
+	return nil
+}
+
+// LoadObject returns a machine with the object loaded into fresh memory,
+// ready to run from its entry point. If opts.Profile is set it must match
+// the object's.
+func LoadObject(o *Object, opts Options) (*Machine, error) {
+	if opts.Profile == (Profile{}) {
+		opts.Profile = o.Profile.orDefault()
+	}
+	if opts.Profile != o.Profile.orDefault() {
+		return nil, fmt.Errorf("object was assembled for %s, not %s", o.Profile.orDefault(), opts.Profile)
+	}
+
+	opts.Entry = o.Entry
+	opts.Object = o
+	if err := opts.validate(opts.Profile.MemorySize); err != nil {
+		return nil, err
+	}
+
+	memory := opts.Profile.NewMemory()
+	if err := o.Load(memory); err != nil {
+		return nil, err
+	}
+	return NewMachine(memory, opts), nil
+}
+
+// Lookup returns the symbol with the given name
+func (o *Object) Lookup(name string) (Symbol, bool) {
+	for _, s := range o.Symbols {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return Symbol{}, false
+}
+
+// SymbolAt describes addr in terms of the closest label at or before it,
+// for example "loop" or "loop+3". It returns "" if there's no such label.
+func (o *Object) SymbolAt(addr int) string {
+	var best *Symbol
+	for i, s := range o.Symbols {
+		if s.Label && s.Value <= addr && (best == nil || s.Value > best.Value) {
+			best = &o.Symbols[i]
+		}
+	}
+	switch {
+	case best == nil:
+		return ""
+	case best.Value == addr:
+		return best.Name
+	default:
+		return fmt.Sprintf("%s+%d", best.Name, addr-best.Value)
+	}
+}
+
+// LineAt returns the line of source that addr was assembled from
+func (o *Object) LineAt(addr int) (SourceLine, bool) {
+	i := sort.Search(len(o.Lines), func(i int) bool { return o.Lines[i].Addr+o.Lines[i].Size > addr })
+	if i < len(o.Lines) && o.Lines[i].Addr <= addr {
+		return o.Lines[i], true
+	}
+	return SourceLine{}, false
+}
+
+// The object file format is little endian throughout:
+//
+//	magic      "VMO" and a version byte
+//	header     address width (1 byte), memory size and entry (4 each)
+//	segments   count (2), then for each: address and length (4 each)
+//	           followed by the data
+//	symbols    count (2), then for each: value (4), 1 for a label or 0
+//	           for a constant, and the name
+//	files      count (2), then each file name
+//	lines      count (4), then for each: address, size and line (4
+//	           each) and an index into files (2), or 0xffff for none
+//
+// where names are a length (2) followed by that many bytes.
+const (
+	objectMagic   = "VMO"
+	objectVersion = 1
+	noFile        = 0xffff
+)
+
+// MarshalBinary encodes the object in the object file format
+func (o *Object) MarshalBinary() ([]byte, error) {
+	w := &binaryWriter{}
+	w.buf.WriteString(objectMagic)
+	w.buf.WriteByte(objectVersion)
+
+	p := o.Profile.orDefault()
+	w.buf.WriteByte(byte(p.AddressWidth))
+	w.u32(p.MemorySize)
+	w.u32(o.Entry)
+
+	w.u16(len(o.Segments))
+	for _, s := range o.Segments {
+		w.u32(s.Addr)
+		w.u32(len(s.Data))
+		w.buf.Write(s.Data)
+	}
+
+	w.u16(len(o.Symbols))
+	for _, s := range o.Symbols {
+		w.u32(s.Value)
+		label := byte(0)
+		if s.Label {
+			label = 1
+		}
+		w.buf.WriteByte(label)
+		w.str(s.Name)
+	}
+
+	// Most lines come from a handful of files, so each name is only
+	// written once
+	var files []string
+	index := map[string]int{}
+	for _, l := range o.Lines {
+		if _, ok := index[l.File]; !ok && l.File != "" {
+			index[l.File] = len(files)
+			files = append(files, l.File)
+		}
+	}
+	w.u16(len(files))
+	for _, f := range files {
+		w.str(f)
+	}
+
+	w.u32(len(o.Lines))
+	for _, l := range o.Lines {
+		w.u32(l.Addr)
+		w.u32(l.Size)
+		w.u32(l.Line)
+		if l.File == "" {
+			w.u16(noFile)
+		} else {
+			w.u16(index[l.File])
+		}
+	}
+
+	if w.err != nil {
+		return nil, w.err
+	}
+	return w.buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes an object encoded by MarshalBinary, returning
+// an error wrapping ErrBadObject if data isn't a valid object
+func (o *Object) UnmarshalBinary(data []byte) error {
+	r := &binaryReader{r: bytes.NewReader(data)}
+	magic := r.bytes(len(objectMagic) + 1)
+	if r.err != nil || string(magic[:len(objectMagic)]) != objectMagic {
+		return fmt.Errorf("%w: not an object file", ErrBadObject)
+	}
+	if v := magic[len(objectMagic)]; v != objectVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrBadObject, v)
+	}
+
+	var obj Object
+	obj.Profile.AddressWidth = int(r.u8())
+	obj.Profile.MemorySize = r.u32()
+	obj.Entry = r.u32()
+
+	for i, n := 0, r.u16(); i < n && r.err == nil; i++ {
+		addr, size := r.u32(), r.u32()
+		obj.Segments = append(obj.Segments, Segment{Addr: addr, Data: r.bytes(size)})
+	}
+	for i, n := 0, r.u16(); i < n && r.err == nil; i++ {
+		s := Symbol{Value: r.u32(), Label: r.u8() == 1}
+		s.Name = r.str()
+		obj.Symbols = append(obj.Symbols, s)
+	}
+	var files []string
+	for i, n := 0, r.u16(); i < n && r.err == nil; i++ {
+		files = append(files, r.str())
+	}
+	for i, n := 0, r.u32(); i < n && r.err == nil; i++ {
+		l := SourceLine{Addr: r.u32(), Size: r.u32(), Line: r.u32()}
+		if f := r.u16(); f != noFile && r.err == nil {
+			if f >= len(files) {
+				return fmt.Errorf("%w: line %d refers to file %d of %d", ErrBadObject, l.Line, f, len(files))
+			}
+			l.File = files[f]
+		}
+		obj.Lines = append(obj.Lines, l)
+	}
+
+	if r.err != nil {
+		return fmt.Errorf("%w: %s", ErrBadObject, r.err)
+	}
+	if r.r.Len() != 0 {
+		return fmt.Errorf("%w: %d bytes of trailing data", ErrBadObject, r.r.Len())
+	}
+	if err := obj.validate(); err != nil {
+		return fmt.Errorf("%w: %s", ErrBadObject, err)
+	}
+	*o = obj
+	return nil
+}
+
+// validate checks that a decoded object can be loaded
+func (o *Object) validate() error {
+	if err := o.Profile.validate(); err != nil {
+		return err
+	}
+	if o.Entry < 0 || o.Entry >= o.Profile.MemorySize {
+		return fmt.Errorf("entry point %d is out of bounds", o.Entry)
+	}
+	if o.Entry != 0 && o.Entry < ProgramStart {
+		return fmt.Errorf("entry point %d is in the data region", o.Entry)
+	}
+	for _, s := range o.Segments {
+		if s.Addr+len(s.Data) > o.Profile.MemorySize {
+			return fmt.Errorf("segment at %d (%d bytes) is out of bounds", s.Addr, len(s.Data))
+		}
+	}
+	return nil
+}
+
+// binaryWriter encodes the object and snapshot formats, remembering if
+// any value doesn't fit
+type binaryWriter struct {
+	buf bytes.Buffer
+	err error
+}
+
+func (w *binaryWriter) u16(v int) {
+	if v < 0 || v > 0xffff {
+		w.err = fmt.Errorf("%d is out of range", v)
+	}
+	_ = binary.Write(&w.buf, binary.LittleEndian, uint16(v))
+}
+
+func (w *binaryWriter) u32(v int) {
+	if v < 0 || int64(v) > 0xffffffff {
+		w.err = fmt.Errorf("%d is out of range", v)
+	}
+	_ = binary.Write(&w.buf, binary.LittleEndian, uint32(v))
+}
+
+func (w *binaryWriter) u64(v int) {
+	if v < 0 {
+		w.err = fmt.Errorf("%d is out of range", v)
+	}
+	_ = binary.Write(&w.buf, binary.LittleEndian, uint64(v))
+}
+
+func (w *binaryWriter) str(s string) {
+	w.u16(len(s))
+	w.buf.WriteString(s)
+}
+
+// binaryReader decodes the object and snapshot formats, remembering the
+// first error so that callers only need to check once
+type binaryReader struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (r *binaryReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > r.r.Len() {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := make([]byte, n)
+	_, r.err = io.ReadFull(r.r, b)
+	return b
+}
+
+func (r *binaryReader) u8() int {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return int(b[0])
+}
+
+func (r *binaryReader) u16() int {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return int(binary.LittleEndian.Uint16(b))
+}
+
+func (r *binaryReader) u32() int {
+	b := r.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return int(binary.LittleEndian.Uint32(b))
+}
+
+func (r *binaryReader) u64() int {
+	b := r.bytes(8)
+	if b == nil {
+		return 0
+	}
+	v := binary.LittleEndian.Uint64(b)
+	if v > math.MaxInt64 {
+		r.err = fmt.Errorf("%d is out of range", v)
+		return 0
+	}
+	return int(v)
+}
+
+func (r *binaryReader) str() string {
+	return string(r.bytes(r.u16()))
+}
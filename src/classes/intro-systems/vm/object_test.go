@@ -0,0 +1,217 @@
+package vm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+const objectSource = `
+.equ OUT 0
+.org 1
+input: .byte 5
+
+.org 8
+.entry main
+double:
+	add r1 r1
+	ret
+main:
+	load r1 input
+	call double
+	store r1 OUT
+	halt
+.include "lib.asm"
+`
+
+func assembleTestObject(t *testing.T) *Object {
+	t.Helper()
+	a := Assembler{Files: fstest.MapFS{"lib.asm": {Data: []byte("message: .string \"hi\"\n")}}}
+	obj, err := a.AssembleObject(objectSource)
+	if err != nil {
+		t.Fatalf("failed to assemble: %s", err)
+	}
+	return obj
+}
+
+func TestAssembleObject(t *testing.T) {
+	obj := assembleTestObject(t)
+
+	want := &Object{
+		Profile: Profile8,
+		Entry:   0x0c,
+		Segments: []Segment{
+			{Addr: 1, Data: []byte{5}},
+			{Addr: 8, Data: []byte{
+				Add, 0x01, 0x01,
+				Ret,
+				Load, 0x01, 0x01,
+				Call, 0x08,
+				Store, 0x01, 0x00,
+				Halt,
+				'h', 'i', 0,
+			}},
+		},
+		Symbols: []Symbol{
+			{Name: "OUT", Value: 0},
+			{Name: "input", Value: 1, Label: true},
+			{Name: "double", Value: 8, Label: true},
+			{Name: "main", Value: 0x0c, Label: true},
+			{Name: "message", Value: 0x15, Label: true},
+		},
+		Lines: []SourceLine{
+			{Addr: 1, Size: 1, Line: 4},
+			{Addr: 0x08, Size: 3, Line: 9},
+			{Addr: 0x0b, Size: 1, Line: 10},
+			{Addr: 0x0c, Size: 3, Line: 12},
+			{Addr: 0x0f, Size: 2, Line: 13},
+			{Addr: 0x11, Size: 3, Line: 14},
+			{Addr: 0x14, Size: 1, Line: 15},
+			{Addr: 0x15, Size: 3, File: "lib.asm", Line: 1},
+		},
+	}
+	if !reflect.DeepEqual(obj, want) {
+		t.Errorf("got: %+v\nwanted: %+v", obj, want)
+	}
+}
+
+func TestObjectLookups(t *testing.T) {
+	obj := assembleTestObject(t)
+
+	for _, test := range []struct {
+		addr   int
+		symbol string
+		line   string
+	}{
+		{0, "", ""},
+		{1, "input", "line 4"},
+		{2, "input+1", ""},
+		{0x08, "double", "line 9"},
+		{0x0a, "double+2", "line 9"},
+		{0x0c, "main", "line 12"},
+		{0x16, "message+1", "lib.asm:1"},
+		{0x20, "message+11", ""},
+	} {
+		if got := obj.SymbolAt(test.addr); got != test.symbol {
+			t.Errorf("SymbolAt(%#x) got: %q, wanted: %q", test.addr, got, test.symbol)
+		}
+		l, ok := obj.LineAt(test.addr)
+		if got := l.String(); ok != (test.line != "") || ok && got != test.line {
+			t.Errorf("LineAt(%#x) got: %q, %v, wanted: %q", test.addr, got, ok, test.line)
+		}
+	}
+
+	if s, ok := obj.Lookup("main"); !ok || s.Value != 0x0c {
+		t.Errorf("Lookup(main) got: %+v, %v", s, ok)
+	}
+	if _, ok := obj.Lookup("nowhere"); ok {
+		t.Errorf("Lookup(nowhere) found a symbol")
+	}
+}
+
+func TestObjectRoundTrip(t *testing.T) {
+	obj := assembleTestObject(t)
+	obj.Profile = Profile16
+
+	data, err := obj.MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var got Object
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(&got, obj) {
+		t.Errorf("got: %+v\nwanted: %+v", got, obj)
+	}
+}
+
+func TestUnmarshalBadObject(t *testing.T) {
+	data, err := (&Object{Entry: ProgramStart, Segments: []Segment{{Addr: 8, Data: []byte{Halt, Halt}}}}).MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var obj Object
+	if err := obj.UnmarshalBinary(data); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Patches a copy of data
+	patch := func(i int, b ...byte) []byte {
+		patched := append([]byte(nil), data...)
+		copy(patched[i:], b)
+		return patched
+	}
+	for _, test := range []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"Empty", nil, "not an object file"},
+		{"Magic", patch(0, 'X'), "not an object file"},
+		{"Version", patch(3, 2), "unsupported version 2"},
+		{"Truncated", data[:len(data)-1], "unexpected EOF"},
+		{"Trailing", append(append([]byte(nil), data...), 0), "1 bytes of trailing data"},
+		{"Profile", patch(4, 3), "address width must be 1 or 2 bytes"},
+		{"Entry", patch(9, 0, 1), "entry point 256 is out of bounds"},
+		{"EntryInData", patch(9, 3), "entry point 3 is in the data region"},
+		{"Segment", patch(15, 0xff), "segment at 255 (2 bytes) is out of bounds"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := obj.UnmarshalBinary(test.data)
+			if !errors.Is(err, ErrBadObject) || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got: %v, wanted an ErrBadObject containing %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadObject(t *testing.T) {
+	obj := assembleTestObject(t)
+
+	var trace bytes.Buffer
+	m, err := LoadObject(obj, Options{Tracer: NewTextTracer(&trace)})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if m.PC() != obj.Entry {
+		t.Errorf("got pc: %#x, wanted: %#x", m.PC(), obj.Entry)
+	}
+	if err := m.Continue(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := m.Memory()[0]; got != 10 {
+		t.Errorf("got: %d, wanted: 10", got)
+	}
+
+	want := `main:
+     0  0x0c  load r1 1          r1=5 (was 0) ; line 12
+     1  0x0f  call 8             [255]=17 (was 0) ; line 13
+double:
+     2  0x08  add r1 r1          r1=10 (was 5) ; line 9
+     3  0x0b  ret                ; line 10
+     4  0x11  store r1 0         [0]=10 (was 0) ; line 14
+     5  0x14  halt               ; line 15
+`
+	if trace.String() != want {
+		t.Errorf("got:\n%s\nwanted:\n%s", trace.String(), want)
+	}
+
+	for _, profile := range []Profile{Profile16, {MemorySize: 128, AddressWidth: 1}} {
+		want := "object was assembled for 256 bytes of memory and 1 byte addresses, not " + profile.String()
+		if _, err := LoadObject(obj, Options{Profile: profile}); err == nil || err.Error() != want {
+			t.Errorf("got %v loading with the wrong profile, wanted %q", err, want)
+		}
+	}
+	big := &Object{Segments: []Segment{{Addr: 250, Data: make([]byte, 10)}}}
+	if _, err := LoadObject(big, Options{}); err == nil {
+		t.Errorf("expected an error loading a segment that doesn't fit")
+	}
+	if _, err := LoadObject(obj, Options{Registers: MaxRegisters + 1}); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("got %v loading with invalid options, wanted an ErrInvalidOptions", err)
+	}
+}
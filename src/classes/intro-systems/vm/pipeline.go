@@ -0,0 +1,608 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// PipelineOptions configures RunPipelined
+type PipelineOptions struct {
+	Options
+	// Forwarding passes results from the EX and MEM stages straight to
+	// the instructions that need them. Without it, an instruction waits
+	// in ID until its operands have been written back.
+	Forwarding bool
+	// PredictNotTaken carries on fetching past a branch, and flushes
+	// what was fetched if the branch turns out to be taken. Without it,
+	// fetch stalls until every branch is resolved.
+	PredictNotTaken bool
+}
+
+// PipelineStats describes how well the pipeline was kept busy
+type PipelineStats struct {
+	// Cycles is the number of clock cycles the pipeline ran for, unlike
+	// Counters.Cycles which comes from the cost table
+	Cycles int
+	// DataStalls counts the cycles an instruction waited in ID for one
+	// of its operands
+	DataStalls int
+	// ControlStalls counts the cycles fetch waited for a branch to be
+	// resolved, without PredictNotTaken
+	ControlStalls int
+	// Flushes counts the instructions fetched and then thrown away,
+	// because of a taken branch or a store to an instruction that was
+	// already in the pipeline
+	Flushes int
+}
+
+// ErrPipelineUnsupported is returned by RunPipelined when its options
+// ask for something the pipeline doesn't model
+var ErrPipelineUnsupported = errors.New("not supported by the pipeline")
+
+// The flags and the stack pointer are treated as registers, so that
+// hazards on them are detected in the same way
+const (
+	regFlags = MaxRegisters + 1 + iota
+	regSP
+)
+
+// The stages that can redirect fetch
+const (
+	stageEX = iota
+	stageMEM
+)
+
+// RunPipelined runs the program stored in memory on a classic five stage
+// pipeline (IF, ID, EX, MEM and WB), rather than an instruction at a
+// time. The architectural results are the same as RunContext's, apart
+// from the cache statistics, which include instructions that were
+// fetched and then flushed.
+//
+// Registers are read in EX and written back in WB, loads and stores
+// happen in MEM, branches are resolved in EX (or MEM, for ret and iret)
+// and faults are raised in WB, so they're precise: nothing after the
+// faulting instruction has any effect.
+//
+// Interrupts aren't modelled, so the pipeline only runs the ISA without
+// them: ei, di and iret behave as they do on the interpreter, but no
+// interrupt is ever taken. Tracers aren't supported either. If opts sets
+// a Tracer or an InterruptVector, RunPipelined returns an error wrapping
+// ErrPipelineUnsupported without running anything, and likewise an
+// error wrapping ErrInvalidOptions if they're invalid.
+func RunPipelined(ctx context.Context, memory []byte, opts PipelineOptions) (Result, PipelineStats, error) {
+	switch err := opts.validate(len(memory)); {
+	case err != nil:
+		return Result{}, PipelineStats{}, err
+	case opts.Tracer != nil:
+		return Result{}, PipelineStats{}, fmt.Errorf("tracers are %w", ErrPipelineUnsupported)
+	case opts.InterruptVector != 0:
+		return Result{}, PipelineStats{}, fmt.Errorf("interrupts are %w", ErrPipelineUnsupported)
+	}
+
+	p := &pipeline{
+		m:        NewMachine(memory, opts.Options),
+		opts:     opts,
+		fetching: true,
+	}
+	p.fetchPC = p.m.pc
+	for _, in := range instructions {
+		if size := p.m.profile.size(in); size > p.maxSize {
+			p.maxSize = size
+		}
+	}
+
+	for {
+		if p.draining == nil && ctx.Err() != nil {
+			p.draining = ctx.Err()
+		}
+		p.stats.Cycles++
+
+		// Each stage consumes what the one before it produced last
+		// cycle, so they run back to front
+		if done, err := p.writeBack(); done {
+			return p.m.Result(), p.stats, err
+		}
+		p.memory()
+		p.execute()
+		p.decode()
+		p.fetch()
+		p.endCycle()
+	}
+}
+
+type pipeline struct {
+	m     *Machine
+	opts  PipelineOptions
+	stats PipelineStats
+
+	fetchPC  int
+	fetching bool // stops after fetching a halt, or failing to fetch
+	maxSize  int  // the longest instruction, in bytes
+	// waiting is the branch that fetch is stalled on, without
+	// PredictNotTaken
+	waiting *uop
+
+	// The latches between stages, named after the stages either side
+	ifid, idex, exmem, memwb *uop
+
+	// Where to fetch from next cycle, if not the following instruction
+	redirect *redirect
+	// Set once the context is cancelled, so that nothing else gets as
+	// far as MEM
+	draining error
+}
+
+type redirect struct {
+	stage int
+	pc    int
+	from  *uop
+}
+
+// uop is an instruction in flight
+type uop struct {
+	pc, next int
+	op       byte
+	args     []int
+	err      error
+	// budget is set if the instruction would have run after the budget
+	// was exhausted, so mustn't retire
+	budget error
+
+	reads  []int
+	writes []pipeWrite
+
+	val     int  // the register being stored or pushed
+	sp      int  // the stack pointer, for stack operations
+	stacked bool // the stack was accessed, and sp may have moved
+	newPC   int
+	taken   bool // a conditional branch was taken
+}
+
+// pipeWrite is a result written back to a register, the flags or the
+// stack pointer. Late results aren't known until the MEM stage.
+type pipeWrite struct {
+	reg  int
+	val  int
+	late bool
+}
+
+// dataflow works out which registers an instruction reads and writes
+func (u *uop) dataflow() {
+	a := u.args
+	switch u.op {
+	case Load:
+		u.writes = []pipeWrite{{reg: a[0], late: true}}
+	case Store:
+		u.reads = []int{a[0]}
+	case Add, Sub:
+		u.reads = []int{a[0], a[1]}
+		u.writes = []pipeWrite{{reg: a[0]}, {reg: regFlags}}
+	case Addi, Subi:
+		u.reads = []int{a[0]}
+		u.writes = []pipeWrite{{reg: a[0]}, {reg: regFlags}}
+	case Mul, Div, Mod, And, Or, Xor, Shl, Shr:
+		u.reads = []int{a[0], a[1]}
+		u.writes = []pipeWrite{{reg: a[0]}}
+	case Not:
+		u.reads = []int{a[0]}
+		u.writes = []pipeWrite{{reg: a[0]}}
+	case Push:
+		u.reads = []int{a[0], regSP}
+		u.writes = []pipeWrite{{reg: regSP, late: true}}
+	case Pop:
+		u.reads = []int{regSP}
+		u.writes = []pipeWrite{{reg: a[0], late: true}, {reg: regSP, late: true}}
+	case Call, Ret:
+		u.reads = []int{regSP}
+		u.writes = []pipeWrite{{reg: regSP, late: true}}
+	case Iret:
+		u.reads = []int{regSP}
+		u.writes = []pipeWrite{{reg: regFlags, late: true}, {reg: regSP, late: true}}
+	case Cmp:
+		u.reads = []int{a[0], a[1]}
+		u.writes = []pipeWrite{{reg: regFlags}}
+	case Beq, Bne, Blt, Bge, Bltu, Bgeu:
+		u.reads = []int{regFlags}
+	case Beqz:
+		u.reads = []int{a[0]}
+	}
+}
+
+// write returns the instruction's write to reg, or nil if it has none
+func (u *uop) write(reg int) *pipeWrite {
+	for i := range u.writes {
+		if u.writes[i].reg == reg {
+			return &u.writes[i]
+		}
+	}
+	return nil
+}
+
+func (u *uop) set(reg, val int) {
+	u.write(reg).val = val
+}
+
+func isControl(op byte) bool {
+	switch op {
+	case Jump, Call, Ret, Iret, Beqz, Beq, Bne, Blt, Bge, Bltu, Bgeu:
+		return true
+	}
+	return false
+}
+
+func (p *pipeline) fetch() {
+	if p.ifid != nil || !p.fetching {
+		return
+	}
+	if p.waiting != nil {
+		p.stats.ControlStalls++
+		return
+	}
+
+	u := &uop{pc: p.fetchPC}
+	p.m.pc = u.pc
+	u.op, u.args, u.next, u.err = p.m.fetch(u.pc)
+	if u.err != nil {
+		// There's nothing sensible to fetch next, but a store could
+		// still fix the instruction up
+		u.next = u.pc + p.maxSize
+		p.fetching = false
+	} else {
+		u.dataflow()
+	}
+
+	if u.op == Halt {
+		p.fetching = false
+	}
+	if !p.opts.PredictNotTaken && isControl(u.op) {
+		p.waiting = u
+	}
+	p.fetchPC = u.next
+	p.ifid = u
+}
+
+func (p *pipeline) decode() {
+	u := p.ifid
+	if u == nil {
+		return
+	}
+	if u.err == nil && p.hazard(u) {
+		p.stats.DataStalls++
+		return
+	}
+	p.ifid, p.idex = nil, u
+}
+
+// hazard reports whether u needs to wait before going on to EX. The
+// instruction just ahead of it has only finished EX, so its late results
+// can't be forwarded yet, and without forwarding nothing can be.
+func (p *pipeline) hazard(u *uop) bool {
+	for _, r := range u.reads {
+		if x := p.exmem; x != nil {
+			if w := x.write(r); w != nil && (w.late || !p.opts.Forwarding) {
+				return true
+			}
+		}
+		if x := p.memwb; x != nil && !p.opts.Forwarding && x.write(r) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// operand reads a register in EX. Everything older has been written
+// back, apart from the instruction that has just been through MEM.
+func (p *pipeline) operand(reg int) int {
+	if x := p.memwb; x != nil {
+		if w := x.write(reg); w != nil {
+			return w.val
+		}
+	}
+	switch reg {
+	case regFlags:
+		return int(p.m.flags)
+	case regSP:
+		return p.m.sp
+	}
+	return int(p.m.registers[reg])
+}
+
+func (p *pipeline) execute() {
+	u := p.idex
+	if u == nil {
+		return
+	}
+	p.idex, p.exmem = nil, u
+	if u.err != nil {
+		return
+	}
+
+	a := u.args
+	u.newPC = u.next
+	switch u.op {
+	case Add, Addi, Sub, Subi:
+		x, y := byte(p.operand(a[0])), byte(a[1])
+		if u.op == Add || u.op == Sub {
+			y = byte(p.operand(a[1]))
+		}
+		res, flags := add(x, y)
+		if u.op == Sub || u.op == Subi {
+			res, flags = sub(x, y)
+		}
+		u.set(a[0], int(res))
+		u.set(regFlags, int(flags))
+
+	case Cmp:
+		_, flags := sub(byte(p.operand(a[0])), byte(p.operand(a[1])))
+		u.set(regFlags, int(flags))
+
+	case Mul, Div, Mod, And, Or, Xor, Shl, Shr:
+		x, y := byte(p.operand(a[0])), byte(p.operand(a[1]))
+		if (u.op == Div || u.op == Mod) && y == 0 {
+			u.err = ErrDivideByZero{PC: u.pc}
+			return
+		}
+		u.set(a[0], int(alu(u.op, x, y)))
+
+	case Not:
+		u.set(a[0], int(^byte(p.operand(a[0]))))
+
+	case Store:
+		u.val = p.operand(a[0])
+
+	case Push:
+		u.val, u.sp = p.operand(a[0]), p.operand(regSP)
+
+	case Pop, Ret, Iret:
+		u.sp = p.operand(regSP)
+
+	case Call:
+		u.sp = p.operand(regSP)
+		u.newPC = a[0]
+
+	case Jump:
+		u.newPC = a[0]
+
+	case Beq, Bne, Blt, Bge, Bltu, Bgeu:
+		if Flags(p.operand(regFlags)).taken(u.op) {
+			u.taken = true
+			u.newPC = u.next + int(int8(a[0]))
+		}
+
+	case Beqz:
+		if p.operand(a[0]) == 0 {
+			u.taken = true
+			u.newPC = u.next + a[1]
+		}
+	}
+
+	if isControl(u.op) && u.op != Ret && u.op != Iret {
+		p.resolve(stageEX, u)
+	}
+}
+
+func (p *pipeline) memory() {
+	u := p.exmem
+	if u == nil {
+		return
+	}
+	p.exmem, p.memwb = nil, u
+
+	m := p.m
+	m.pc = u.pc
+	if p.draining != nil || (m.opts.MaxSteps > 0 && m.steps >= m.opts.MaxSteps) {
+		u.budget = ErrBudgetExhausted{PC: u.pc, Steps: m.steps, Err: p.draining}
+		return
+	}
+	if u.err != nil {
+		return
+	}
+	if u.err = p.access(u); u.err != nil {
+		return
+	}
+
+	if u.op == Ret || u.op == Iret {
+		p.resolve(stageMEM, u)
+	}
+	if p.overwritesFetched(u) {
+		p.setRedirect(stageMEM, u.newPC, u)
+	}
+}
+
+// access performs an instruction's loads and stores, in the same order
+// as the interpreter does
+func (p *pipeline) access(u *uop) error {
+	m := p.m
+	switch u.op {
+	case Load:
+		from := u.args[1]
+		if err := m.check(from, 1, PermRead); err != nil {
+			return err
+		}
+		v, err := m.read(from)
+		if err != nil {
+			return err
+		}
+		u.set(u.args[0], int(v))
+
+	case Store:
+		to := u.args[1]
+		if err := m.check(to, 1, PermWrite); err != nil {
+			return err
+		}
+		return m.write(to, byte(u.val))
+
+	case Push, Pop, Call, Ret, Iret:
+		// The stack helpers use the machine's stack pointer, which
+		// isn't updated until write back
+		sp := m.sp
+		m.sp = u.sp
+		err := p.stack(u)
+		u.set(regSP, m.sp)
+		u.stacked = true
+		m.sp = sp
+		return err
+	}
+	return nil
+}
+
+func (p *pipeline) stack(u *uop) error {
+	m := p.m
+	switch u.op {
+	case Push:
+		return m.push(byte(u.val))
+
+	case Pop:
+		v, err := m.pop()
+		if err != nil {
+			return err
+		}
+		u.set(u.args[0], int(v))
+
+	case Call:
+		return m.pushAddr(u.next)
+
+	case Ret:
+		addr, err := m.popAddr()
+		if err != nil {
+			return err
+		}
+		u.newPC = addr
+
+	case Iret:
+		flags, err := m.pop()
+		if err != nil {
+			return err
+		}
+		addr, err := m.popAddr()
+		if err != nil {
+			return err
+		}
+		u.set(regFlags, int(flags))
+		u.newPC = addr
+	}
+	return nil
+}
+
+// overwritesFetched reports whether u wrote to any instruction that has
+// already been fetched, which will need fetching again
+func (p *pipeline) overwritesFetched(u *uop) bool {
+	var start, end int
+	switch u.op {
+	case Store:
+		start, end = u.args[1], u.args[1]+1
+	case Push:
+		start, end = u.sp-1, u.sp
+	case Call:
+		start, end = u.sp-p.m.profile.AddressWidth, u.sp
+	default:
+		return false
+	}
+
+	for _, x := range []*uop{p.idex, p.ifid} {
+		if x != nil && start < x.next && x.pc < end {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *pipeline) writeBack() (bool, error) {
+	u := p.memwb
+	if u == nil {
+		return false, nil
+	}
+	p.memwb = nil
+
+	m := p.m
+	m.pc = u.pc
+	if u.budget != nil {
+		m.reason = BudgetExhausted
+		return true, u.budget
+	}
+	if u.err != nil {
+		// As with the interpreter, a stack operation that faults part
+		// way through leaves the stack pointer where it got to
+		if u.stacked {
+			m.sp = u.write(regSP).val
+		}
+		m.stop(Faulted, u.err)
+		return true, u.err
+	}
+
+	for _, w := range u.writes {
+		switch w.reg {
+		case regFlags:
+			m.flags = Flags(w.val)
+		case regSP:
+			m.sp = w.val
+		default:
+			m.registers[w.reg] = byte(w.val)
+		}
+	}
+	switch u.op {
+	case Ei, Iret:
+		m.interrupts = true
+	case Di:
+		m.interrupts = false
+	}
+	if u.taken {
+		m.counters.TakenBranches++
+	}
+	m.retire(u.op)
+
+	if u.op == Halt {
+		m.stop(Halted, nil)
+		return true, nil
+	}
+	m.pc = u.newPC
+	return false, nil
+}
+
+// resolve redirects fetch once a branch's target is known. Predicting
+// not taken, that's only needed if it was taken.
+func (p *pipeline) resolve(stage int, u *uop) {
+	if p.opts.PredictNotTaken && u.newPC == u.next {
+		return
+	}
+	p.setRedirect(stage, u.newPC, u)
+}
+
+// setRedirect records where to fetch from next. Stages run back to
+// front, so the first redirect in a cycle comes from the oldest
+// instruction, and later ones come from instructions it will flush.
+func (p *pipeline) setRedirect(stage, pc int, from *uop) {
+	if p.redirect == nil {
+		p.redirect = &redirect{stage: stage, pc: pc, from: from}
+	}
+}
+
+// endCycle flushes everything younger than a redirecting instruction
+func (p *pipeline) endCycle() {
+	r := p.redirect
+	if r == nil {
+		return
+	}
+	p.redirect = nil
+
+	latches := []**uop{&p.ifid, &p.idex}
+	if r.stage == stageMEM {
+		latches = append(latches, &p.exmem)
+	}
+	for _, l := range latches {
+		if *l == nil {
+			continue
+		}
+		if *l == p.waiting {
+			p.waiting = nil
+		}
+		p.stats.Flushes++
+		*l = nil
+	}
+
+	if r.from == p.waiting {
+		p.waiting = nil
+	}
+	p.fetchPC, p.fetching = r.pc, true
+}
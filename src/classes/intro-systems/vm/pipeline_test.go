@@ -0,0 +1,319 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+)
+
+var pipelineConfigs = []struct {
+	name                        string
+	forwarding, predictNotTaken bool
+}{
+	{"Stall", false, false},
+	{"Forwarding", true, false},
+	{"Predict", false, true},
+	{"ForwardingPredict", true, true},
+}
+
+// divergence describes the first difference between the final states of
+// two runs of the same program, or returns "" if they agree. Cache
+// statistics aren't compared, since the pipeline's include instructions
+// it fetched and then flushed.
+func divergence(a, b Result, aErr, bErr error, aMem, bMem []byte) string {
+	switch {
+	case aErr != bErr:
+		return fmt.Sprintf("error: %v != %v", aErr, bErr)
+	case a.Reason != b.Reason:
+		return fmt.Sprintf("reason: %s != %s", a.Reason, b.Reason)
+	case a.PC != b.PC:
+		return fmt.Sprintf("pc: 0x%02x != 0x%02x", a.PC, b.PC)
+	case a.SP != b.SP:
+		return fmt.Sprintf("sp: 0x%02x != 0x%02x", a.SP, b.SP)
+	case a.Flags != b.Flags:
+		return fmt.Sprintf("flags: %s != %s", a.Flags, b.Flags)
+	case a.Steps != b.Steps:
+		return fmt.Sprintf("steps: %d != %d", a.Steps, b.Steps)
+	case a.InterruptsEnabled != b.InterruptsEnabled:
+		return fmt.Sprintf("interrupts enabled: %v != %v", a.InterruptsEnabled, b.InterruptsEnabled)
+	case a.Counters != b.Counters:
+		return fmt.Sprintf("counters: %+v != %+v", a.Counters, b.Counters)
+	}
+	for r := 1; r < len(a.Registers) && r < len(b.Registers); r++ {
+		if a.Registers[r] != b.Registers[r] {
+			return fmt.Sprintf("r%d: %d != %d", r, a.Registers[r], b.Registers[r])
+		}
+	}
+	for addr := range aMem {
+		if aMem[addr] != bMem[addr] {
+			return fmt.Sprintf("[0x%02x]: %d != %d", addr, aMem[addr], bMem[addr])
+		}
+	}
+	return ""
+}
+
+// runBoth runs a program on the interpreter and on each pipeline
+// configuration, and checks they end up in the same state
+func runBoth(t *testing.T, mc []byte, x, y byte, opts Options) {
+	t.Helper()
+
+	load := func() []byte {
+		memory := make([]byte, 256)
+		copy(memory[ProgramStart:], mc)
+		memory[1], memory[2] = x, y
+		return memory
+	}
+
+	want := load()
+	wantResult, wantErr := RunContext(context.Background(), want, opts)
+
+	for _, config := range pipelineConfigs {
+		got := load()
+		popts := PipelineOptions{Options: opts, Forwarding: config.forwarding, PredictNotTaken: config.predictNotTaken}
+		gotResult, _, gotErr := RunPipelined(context.Background(), got, popts)
+
+		if gotErr != wantErr {
+			t.Errorf("%s: f(%d, %d) got error: %v, wanted: %v", config.name, x, y, gotErr, wantErr)
+		}
+		if !reflect.DeepEqual(gotResult, wantResult) {
+			t.Errorf("%s: f(%d, %d) got: %+v, wanted: %+v", config.name, x, y, gotResult, wantResult)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: f(%d, %d) memory differs:\n% x\nwanted:\n% x", config.name, x, y, got, want)
+		}
+	}
+}
+
+func TestPipelineMatchesInterpreter(t *testing.T) {
+	for _, tests := range [][]vmTest{mainTests, stretchGoalTests, aluTests, stackTests, branchTests} {
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				mc, err := Assemble(test.asm)
+				if err != nil {
+					t.Fatalf("failed to assemble: %s", err)
+				}
+				for _, c := range test.cases {
+					runBoth(t, mc, c.x, c.y, Options{MaxSteps: 10000})
+				}
+			})
+		}
+	}
+}
+
+func TestPipelineEdgeCases(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		asm  string
+		opts Options
+	}{
+		{"SelfModifying", `
+	load r2 2
+	store r2 14    ; overwrites the opcode of the addi below
+	addi r1 1
+	store r1 0
+	halt`, Options{}},
+		{"DivideByZero", `
+	load r1 1
+	store r1 0
+	div r1 r2
+	store r1 0     ; mustn't happen
+	halt`, Options{}},
+		{"Budget", `
+	load r1 1
+loop:
+	addi r1 1
+	store r1 0
+	jump loop`, Options{MaxSteps: 50}},
+		{"StackOverflow", `
+loop:
+	push r1
+	call loop`, Options{StackSize: 9}},
+		{"StackUnderflow", `
+	pop r1`, Options{}},
+		{"ReturnAfterPush", `
+	load r1 1
+	call sub
+	store r1 0
+	halt
+sub:
+	push r1
+	pop r2
+	add r1 r2
+	ret`, Options{}},
+		{"Protection", `
+	load r1 1
+	store r1 8`, Options{Regions: DefaultRegions(256, 0)}},
+		{"RunOffTheEnd", `
+	jump 250`, Options{}},
+		{"Interrupts", `
+	ei
+	di
+	ei
+	halt`, Options{}},
+		{"LoadUse", `
+	load r1 1
+	load r2 2
+	add r1 r2
+	cmp r1 r2
+	bltu less
+	sub r1 r2
+less:
+	store r1 0
+	halt`, Options{}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			mc, err := Assemble(test.asm)
+			if err != nil {
+				t.Fatalf("failed to assemble: %s", err)
+			}
+			for _, in := range [][2]byte{{0, 0}, {5, Subi}, {200, 100}, {3, 0}} {
+				runBoth(t, mc, in[0], in[1], test.opts)
+			}
+		})
+	}
+}
+
+func TestPipelineHazards(t *testing.T) {
+	for _, test := range []struct {
+		name            string
+		asm             string
+		forwarding      bool
+		predictNotTaken bool
+		want            PipelineStats
+	}{
+		// Five instructions take five cycles to fill the pipeline, then
+		// one each
+		{"NoHazards", `
+	load r1 1
+	load r2 2
+	addi r3 1
+	addi r4 1
+	halt`, true, true, PipelineStats{Cycles: 9}},
+		// The add has to wait a cycle for r2 to be loaded
+		{"LoadUse", `
+	load r1 1
+	load r2 2
+	add r1 r2
+	halt`, true, true, PipelineStats{Cycles: 9, DataStalls: 1}},
+		// Without forwarding, it waits until r2 is written back
+		{"LoadUseNoForwarding", `
+	load r1 1
+	load r2 2
+	add r1 r2
+	halt`, false, true, PipelineStats{Cycles: 10, DataStalls: 2}},
+		// A chain of ALU operations doesn't stall with forwarding...
+		{"ALUChain", `
+	addi r1 1
+	addi r1 1
+	addi r1 1
+	halt`, true, true, PipelineStats{Cycles: 8}},
+		// ...but does without
+		{"ALUChainNoForwarding", `
+	addi r1 1
+	addi r1 1
+	addi r1 1
+	halt`, false, true, PipelineStats{Cycles: 12, DataStalls: 4}},
+		// A taken jump flushes the two instructions behind it
+		{"TakenJump", `
+	jump over
+	addi r1 1
+	addi r1 1
+over:
+	halt`, true, true, PipelineStats{Cycles: 8, Flushes: 2}},
+		// Without prediction, fetch waits for the jump instead
+		{"TakenJumpNoPrediction", `
+	jump over
+	addi r1 1
+	addi r1 1
+over:
+	halt`, true, false, PipelineStats{Cycles: 8, ControlStalls: 2}},
+		// A branch that isn't taken costs nothing when predicted
+		{"NotTaken", `
+	addi r1 1
+	beqz r1 over
+	addi r1 1
+over:
+	halt`, true, true, PipelineStats{Cycles: 8}},
+		// Fetch stops after a halt, so the call only flushes that. The
+		// return address comes from memory, so ret is resolved in MEM
+		// and there are three instructions to flush.
+		{"Return", `
+	call sub
+	halt
+sub:
+	ret
+	addi r1 1
+	addi r1 1
+	addi r1 1`, true, true, PipelineStats{Cycles: 12, Flushes: 4}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			mc, err := Assemble(test.asm)
+			if err != nil {
+				t.Fatalf("failed to assemble: %s", err)
+			}
+			memory := make([]byte, 256)
+			copy(memory[ProgramStart:], mc)
+
+			opts := PipelineOptions{Forwarding: test.forwarding, PredictNotTaken: test.predictNotTaken}
+			_, stats, err := RunPipelined(context.Background(), memory, opts)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if stats != test.want {
+				t.Errorf("got: %+v, wanted: %+v", stats, test.want)
+			}
+		})
+	}
+}
+
+func TestPipelineUnsupported(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		opts Options
+	}{
+		{"Tracer", Options{Tracer: NewTextTracer(io.Discard)}},
+		{"Interrupts", Options{InterruptVector: testVector}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			memory := make([]byte, 256)
+			memory[ProgramStart] = Halt
+			_, _, err := RunPipelined(context.Background(), memory, PipelineOptions{Options: test.opts})
+			if !errors.Is(err, ErrPipelineUnsupported) {
+				t.Errorf("got %v, wanted an ErrPipelineUnsupported", err)
+			}
+		})
+	}
+}
+
+func TestPipelineCancelled(t *testing.T) {
+	mc, err := Assemble("loop: jump loop")
+	if err != nil {
+		t.Fatalf("failed to assemble: %s", err)
+	}
+	memory := make([]byte, 256)
+	copy(memory[ProgramStart:], mc)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result, _, err := RunPipelined(ctx, memory, PipelineOptions{})
+	if want := (ErrBudgetExhausted{PC: ProgramStart, Err: context.Canceled}); err != want {
+		t.Errorf("got: %v, wanted: %v", err, want)
+	}
+	if result.Reason != BudgetExhausted {
+		t.Errorf("got reason %s", result.Reason)
+	}
+}
+
+func ExampleRunPipelined() {
+	mc, _ := Assemble(sumToN)
+	memory := make([]byte, 256)
+	copy(memory[ProgramStart:], mc)
+	memory[1] = 10
+
+	_, stats, _ := RunPipelined(context.Background(), memory, PipelineOptions{Forwarding: true, PredictNotTaken: true})
+	fmt.Println(memory[0], stats.Cycles > 0, stats.Flushes > 0)
+	// Output: 55 true true
+}
@@ -0,0 +1,94 @@
+package vm
+
+import "fmt"
+
+// Profile describes the shape of a machine's address space: how much
+// memory it has, and how many bytes it takes to encode an address.
+// Addresses wider than a byte are stored little endian, both in
+// instructions and on the stack.
+type Profile struct {
+	MemorySize   int `json:"memory_size"`
+	AddressWidth int `json:"address_width"`
+}
+
+var (
+	// Profile8 is the original machine, with 256 bytes of memory and
+	// single byte addresses. It's the default.
+	Profile8 = Profile{MemorySize: 256, AddressWidth: 1}
+	// Profile16 has 64 KiB of memory and two byte addresses
+	Profile16 = Profile{MemorySize: 1 << 16, AddressWidth: 2}
+)
+
+func (p Profile) String() string {
+	return fmt.Sprintf("%d bytes of memory and %d byte addresses", p.MemorySize, p.AddressWidth)
+}
+
+func (p Profile) orDefault() Profile {
+	if p == (Profile{}) {
+		return Profile8
+	}
+	return p
+}
+
+func (p Profile) validate() error {
+	if p.AddressWidth != 1 && p.AddressWidth != 2 {
+		return fmt.Errorf("address width must be 1 or 2 bytes, not %d", p.AddressWidth)
+	}
+	if p.MemorySize <= ProgramStart || p.MemorySize > p.maxAddress()+1 {
+		return fmt.Errorf("memory size must be between %d and %d bytes for %d byte addresses, not %d",
+			ProgramStart+1, p.maxAddress()+1, p.AddressWidth, p.MemorySize)
+	}
+	return nil
+}
+
+// NewMemory returns a zeroed memory image for the profile
+func (p Profile) NewMemory() []byte {
+	return make([]byte, p.orDefault().MemorySize)
+}
+
+func (p Profile) maxAddress() int {
+	return 1<<(8*p.AddressWidth) - 1
+}
+
+// width returns the number of bytes an operand takes up
+func (p Profile) width(kind operand) int {
+	if kind == addrOperand {
+		return p.AddressWidth
+	}
+	return 1
+}
+
+// size returns the number of bytes the instruction occupies in memory
+func (p Profile) size(in instruction) int {
+	size := 1
+	for _, kind := range in.operands {
+		size += p.width(kind)
+	}
+	return size
+}
+
+// decode returns the value of each of an instruction's operands, given
+// the raw bytes of the instruction (starting with the opcode)
+func (p Profile) decode(in instruction, raw []byte) []int {
+	if len(in.operands) == 0 {
+		return nil
+	}
+
+	args := make([]int, len(in.operands))
+	i := 1
+	for n, kind := range in.operands {
+		for b := 0; b < p.width(kind); b++ {
+			args[n] |= int(raw[i]) << (8 * b)
+			i++
+		}
+	}
+	return args
+}
+
+// encode appends an operand's value to mc
+func (p Profile) encode(mc []byte, kind operand, v int) []byte {
+	for b := 0; b < p.width(kind); b++ {
+		mc = append(mc, byte(v>>(8*b)))
+	}
+	return mc
+}
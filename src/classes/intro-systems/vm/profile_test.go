@@ -0,0 +1,108 @@
+package vm
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestAssembleProfile16(t *testing.T) {
+	got, err := Assembler{Profile: Profile16}.Assemble(`
+	load r1 0x1234
+	store r2 300
+	jump end
+	call end
+	beqz r1 end
+	bne end
+end:
+	halt`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	want := []byte{
+		Load, 0x01, 0x34, 0x12,
+		Store, 0x02, 0x2c, 0x01,
+		Jump, 0x1b, 0x00,
+		Call, 0x1b, 0x00,
+		Beqz, 0x01, 0x02, // offsets are still a single byte
+		Bne, 0x00,
+		Halt,
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got: % x, wanted: % x", got, want)
+	}
+
+	// but don't fit in 8 bits
+	if _, err := Assemble("load r1 0x1234"); err == nil {
+		t.Errorf("expected an error assembling a 16 bit address for Profile8")
+	}
+}
+
+func TestProfile16(t *testing.T) {
+	// Too long to fit in 256 bytes, and calls a subroutine placed well
+	// beyond the first 256 bytes
+	asm := `
+	load r1 1
+	call far
+	store r1 0
+	halt
+` + strings.Repeat("\thalt\n", 1000) + `
+far:
+	load r2 2
+	add r1 r2
+	ret`
+
+	mc, err := Assembler{Profile: Profile16}.Assemble(asm)
+	if err != nil {
+		t.Fatalf("failed to assemble: %s", err)
+	}
+	memory := Profile16.NewMemory()
+	copy(memory[ProgramStart:], mc)
+	memory[1], memory[2] = 3, 4
+
+	result, err := RunContext(context.Background(), memory, Options{Profile: Profile16, MaxSteps: 100})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if memory[0] != 7 {
+		t.Errorf("got output %d, wanted 7", memory[0])
+	}
+	if result.SP != len(memory) {
+		t.Errorf("expected the stack to be empty, got sp=%d", result.SP)
+	}
+
+	// The return address should have been pushed as two bytes
+	if ret := int(memory[len(memory)-2]) | int(memory[len(memory)-1])<<8; ret != ProgramStart+7 {
+		t.Errorf("got return address 0x%04x, wanted 0x%04x", ret, ProgramStart+7)
+	}
+}
+
+func TestDisassembleProfile16(t *testing.T) {
+	memory := []byte{0, 0, 0, 0, 0, 0, 0, 0, Jump, 0x34, 0x12, Load, 0x01, 0x00, 0x01}
+
+	got := DisassembleProfile(Profile16, memory, ProgramStart)
+	want := "0x08  07 34 12  jump 4660      ; -> 0x1234\n" +
+		"0x0b  01 01 00 01 load r1 256\n"
+	if got != want {
+		t.Errorf("got:\n%s\nwanted:\n%s", got, want)
+	}
+}
+
+func TestProfileValidation(t *testing.T) {
+	for _, p := range []Profile{
+		{MemorySize: 256, AddressWidth: 3},
+		{MemorySize: 257, AddressWidth: 1},
+		{MemorySize: 4, AddressWidth: 1},
+	} {
+		if err := p.validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", p)
+		}
+	}
+	for _, p := range []Profile{Profile8, Profile16, {MemorySize: 1024, AddressWidth: 2}} {
+		if err := p.validate(); err != nil {
+			t.Errorf("expected %+v to be valid, got: %s", p, err)
+		}
+	}
+}
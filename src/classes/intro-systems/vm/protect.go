@@ -0,0 +1,99 @@
+package vm
+
+import "fmt"
+
+// Perm is a set of permissions for a region of memory, or the kind of
+// access an instruction attempted
+type Perm byte
+
+const (
+	PermRead Perm = 1 << iota
+	PermWrite
+	PermExec
+)
+
+func (p Perm) String() string {
+	b := []byte("---")
+	for i, c := range "rwx" {
+		if p&(1<<i) != 0 {
+			b[i] = byte(c)
+		}
+	}
+	return string(b)
+}
+
+// Region grants permissions to the addresses from Start up to, but not
+// including, End
+type Region struct {
+	Start, End int
+	Perm       Perm
+}
+
+// DefaultRegions describes the usual memory layout (see compute): the
+// data region is readable and writable, the instructions are readable
+// and executable, and the stack at the top of memory is readable and
+// writable. A stackSize of zero means DefaultStackSize.
+func DefaultRegions(memorySize, stackSize int) []Region {
+	if stackSize == 0 {
+		stackSize = DefaultStackSize
+	}
+	stackBase := memorySize - stackSize
+	if stackBase < ProgramStart {
+		stackBase = ProgramStart
+	}
+
+	return []Region{
+		{Start: 0, End: ProgramStart, Perm: PermRead | PermWrite},
+		{Start: ProgramStart, End: stackBase, Perm: PermRead | PermExec},
+		{Start: stackBase, End: memorySize, Perm: PermRead | PermWrite},
+	}
+}
+
+// ErrProtection is returned when an instruction accesses memory in a way
+// its region doesn't permit
+type ErrProtection struct {
+	Addr   int
+	PC     int
+	Access Perm
+}
+
+func (e ErrProtection) Error() string {
+	var access string
+	switch e.Access {
+	case PermRead:
+		access = "read from"
+	case PermWrite:
+		access = "write to"
+	default:
+		access = "execute"
+	}
+	return fmt.Sprintf("protection fault: cannot %s address %d (at memory location %d)", access, e.Addr, e.PC)
+}
+
+// permissions flattens regions into the permissions for each address.
+// Where regions overlap, the later one wins.
+func permissions(regions []Region, memorySize int) []Perm {
+	perms := make([]Perm, memorySize)
+	for _, r := range regions {
+		for addr := r.Start; addr < r.End && addr < memorySize; addr++ {
+			if addr >= 0 {
+				perms[addr] = r.Perm
+			}
+		}
+	}
+	return perms
+}
+
+// check returns an ErrProtection if addresses from addr up to addr+n
+// can't be accessed, or nil if the machine isn't enforcing protection
+func (m *Machine) check(addr, n int, access Perm) error {
+	if m.perms == nil {
+		return nil
+	}
+	for a := addr; a < addr+n; a++ {
+		if a < 0 || a >= len(m.perms) || m.perms[a]&access == 0 {
+			return ErrProtection{Addr: a, PC: m.pc, Access: access}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package vm
+
+import (
+	"context"
+	"testing"
+)
+
+func TestProtection(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		asm  string
+		out  byte
+		want error
+	}{
+		{"Allowed", `
+	load r1 1
+	push r1
+	call sub
+	pop r2
+	store r2 0
+	halt
+sub:
+	ret`, 5, nil},
+		{"SelfModifying", `
+	load r1 1
+	store r1 8
+	halt`, 0, ErrProtection{Addr: 8, PC: 11, Access: PermWrite}},
+		{"ReadCode", `
+	load r1 8
+	store r1 0
+	halt`, Load, nil},
+		{"ExecuteData", `
+	jump 0`, 0, ErrProtection{Addr: 0, PC: 0, Access: PermExec}},
+		{"ExecuteStack", `
+	jump 250`, 0, ErrProtection{Addr: 250, PC: 250, Access: PermExec}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			mc, err := Assemble(test.asm)
+			if err != nil {
+				t.Fatalf("failed to assemble: %s", err)
+			}
+			memory := make([]byte, 256)
+			copy(memory[ProgramStart:], mc)
+			memory[0] = Halt
+			memory[1] = 5
+			before := append([]byte(nil), memory...)
+
+			opts := Options{MaxSteps: 100, Regions: DefaultRegions(len(memory), 0)}
+			result, err := RunContext(context.Background(), memory, opts)
+			if err != test.want {
+				t.Fatalf("got: %v, wanted: %v", err, test.want)
+			}
+			if err == nil {
+				if memory[0] != test.out {
+					t.Errorf("got output %d, wanted %d", memory[0], test.out)
+				}
+				return
+			}
+			if result.Reason != Faulted || result.PC != test.want.(ErrProtection).PC {
+				t.Errorf("got: %+v", result)
+			}
+			// The faulting instruction had no effect on memory
+			for addr := 0; addr < 240; addr++ {
+				if memory[addr] != before[addr] {
+					t.Errorf("address %d changed from %d to %d", addr, before[addr], memory[addr])
+				}
+			}
+		})
+	}
+}
+
+func TestProtectionOff(t *testing.T) {
+	mc, err := Assemble(`
+	load r1 8
+	store r1 0
+	halt`)
+	if err != nil {
+		t.Fatalf("failed to assemble: %s", err)
+	}
+	memory := make([]byte, 256)
+	copy(memory[ProgramStart:], mc)
+
+	if _, err := Run(memory); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if memory[0] != Load {
+		t.Errorf("got output %d, wanted %d", memory[0], Load)
+	}
+}
+
+func TestProtectionStack(t *testing.T) {
+	mc, err := Assemble(`
+	push r1
+	halt`)
+	if err != nil {
+		t.Fatalf("failed to assemble: %s", err)
+	}
+	memory := make([]byte, 256)
+	copy(memory[ProgramStart:], mc)
+
+	// The stack is read only
+	regions := append(DefaultRegions(len(memory), 0), Region{Start: 240, End: 256, Perm: PermRead})
+	_, err = RunContext(context.Background(), memory, Options{Regions: regions})
+	if want := (ErrProtection{Addr: 255, PC: 8, Access: PermWrite}); err != want {
+		t.Errorf("got: %v, wanted: %v", err, want)
+	}
+}
+
+func TestPermString(t *testing.T) {
+	for p, want := range map[Perm]string{
+		0:                               "---",
+		PermRead | PermWrite:            "rw-",
+		PermRead | PermExec:             "r-x",
+		PermRead | PermWrite | PermExec: "rwx",
+	} {
+		if got := p.String(); got != want {
+			t.Errorf("got %q, wanted %q", got, want)
+		}
+	}
+}
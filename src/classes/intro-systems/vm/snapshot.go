@@ -0,0 +1,313 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// Stateful is implemented by devices whose state should be saved in a
+// Snapshot. Devices that don't implement it, like Console, must have no
+// state of their own. SaveState returns an error if the device's state
+// can't be saved at the moment, and Machine.Snapshot passes it on.
+type Stateful interface {
+	SaveState() ([]byte, error)
+	RestoreState(state []byte) error
+}
+
+// Snapshot is the complete state of a machine, from which another machine
+// with the same options can carry on exactly where it left off. It can be
+// encoded as JSON or, with MarshalBinary, in a compact binary format.
+//
+// Options, breakpoints and watchpoints aren't part of a machine's state,
+// and neither are its caches, which Restore leaves as they are.
+type Snapshot struct {
+	Profile           Profile  `json:"profile"`
+	PC                int      `json:"pc"`
+	SP                int      `json:"sp"`
+	Flags             Flags    `json:"flags"`
+	InterruptsEnabled bool     `json:"interrupts_enabled"`
+	Registers         []byte   `json:"registers"`
+	Memory            []byte   `json:"memory"`
+	Steps             int      `json:"steps"`
+	Counters          Counters `json:"counters"`
+	// Reason is why the machine last stopped, and Fault is the error it
+	// faulted with, if it did
+	Reason HaltReason `json:"reason"`
+	Fault  string     `json:"fault,omitempty"`
+	// Devices holds the state of each of Options.Devices, in order, or
+	// nil for devices that aren't Stateful
+	Devices [][]byte `json:"devices,omitempty"`
+}
+
+// ErrBadSnapshot is returned when decoding something that isn't a valid
+// snapshot
+var ErrBadSnapshot = errors.New("invalid snapshot")
+
+// Snapshot captures the machine's current state
+func (m *Machine) Snapshot() (*Snapshot, error) {
+	s := &Snapshot{
+		Profile:           m.profile,
+		PC:                m.pc,
+		SP:                m.sp,
+		Flags:             m.flags,
+		InterruptsEnabled: m.interrupts,
+		Registers:         m.Registers(),
+		Memory:            append([]byte(nil), m.memory...),
+		Steps:             m.steps,
+		Counters:          m.counters,
+		Reason:            m.reason,
+	}
+	if m.err != nil {
+		s.Fault = m.err.Error()
+	}
+
+	if len(m.opts.Devices) > 0 {
+		s.Devices = make([][]byte, len(m.opts.Devices))
+	}
+	for i, d := range m.opts.Devices {
+		if sd, ok := d.Device.(Stateful); ok {
+			state, err := sd.SaveState()
+			if err != nil {
+				return nil, fmt.Errorf("saving device at address %d: %w", d.Start, err)
+			}
+			s.Devices[i] = state
+		}
+	}
+	return s, nil
+}
+
+// Restore puts the machine into the state captured by a snapshot. The
+// machine must have the same profile, amount of memory, number of
+// registers and devices as the one the snapshot was taken from, and the
+// snapshot's pc and stack pointer must be within its memory and stack.
+// Memory is restored in place.
+//
+// A machine restored from a snapshot of one that had faulted is faulted
+// too, but with a plain error carrying the original's message.
+func (m *Machine) Restore(s *Snapshot) error {
+	switch {
+	case s.Profile != m.profile:
+		return fmt.Errorf("snapshot is of a machine with %s, not %s", s.Profile, m.profile)
+	case len(s.Memory) != len(m.memory):
+		return fmt.Errorf("snapshot has %d bytes of memory, not %d", len(s.Memory), len(m.memory))
+	case len(s.Registers) != len(m.registers):
+		return fmt.Errorf("snapshot has %d registers, not %d", len(s.Registers)-1, len(m.registers)-1)
+	case len(s.Devices) != len(m.opts.Devices):
+		return fmt.Errorf("snapshot has %d devices, not %d", len(s.Devices), len(m.opts.Devices))
+	// The pc can be just past the end of memory, after running off it
+	case s.PC < 0 || s.PC > len(m.memory):
+		return fmt.Errorf("snapshot's pc %d is out of bounds", s.PC)
+	case s.SP < m.stackBase || s.SP > len(m.memory):
+		return fmt.Errorf("snapshot's stack pointer %d is outside the stack, from %d to %d", s.SP, m.stackBase, len(m.memory))
+	case s.Reason < Halted || s.Reason > Paused:
+		return fmt.Errorf("snapshot has an unknown halt reason %d", s.Reason)
+	}
+
+	// Check every device will accept its state before changing anything
+	for i, d := range m.opts.Devices {
+		if _, ok := d.Device.(Stateful); ok != (s.Devices[i] != nil) {
+			return fmt.Errorf("snapshot doesn't match the device at address %d", d.Start)
+		}
+	}
+	for i, d := range m.opts.Devices {
+		if sd, ok := d.Device.(Stateful); ok {
+			if err := sd.RestoreState(s.Devices[i]); err != nil {
+				return fmt.Errorf("restoring device at address %d: %w", d.Start, err)
+			}
+		}
+	}
+
+	m.pc, m.sp, m.flags, m.interrupts = s.PC, s.SP, s.Flags, s.InterruptsEnabled
+	copy(m.registers, s.Registers)
+	copy(m.memory, s.Memory)
+	m.steps, m.counters = s.Steps, s.Counters
+	m.watchHit = nil
+
+	m.reason, m.stopped, m.err = s.Reason, false, nil
+	switch s.Reason {
+	case Halted:
+		m.stopped = true
+	case Faulted:
+		m.stopped, m.err = true, errors.New(s.Fault)
+	}
+	return nil
+}
+
+// The binary snapshot format is little endian throughout, and uses the
+// same encoding of numbers and names as the object format:
+//
+//	magic      "VMS" and a version byte
+//	profile    address width (1) and memory size (4)
+//	registers  pc and sp (4 each), flags (1), 1 if interrupts are
+//	           enabled (1), and the number of registers (1) followed by
+//	           their values, indexed by register number
+//	memory     length (4) followed by the contents
+//	progress   steps and then each counter (8 each), in the order
+//	           they're declared in Counters
+//	status     reason (1) and the fault message
+//	devices    count (2), then for each: 1 if it has state (1), and if
+//	           so its length (4) followed by the state
+const (
+	snapshotMagic   = "VMS"
+	snapshotVersion = 1
+)
+
+// MarshalBinary encodes the snapshot in the binary snapshot format
+func (s *Snapshot) MarshalBinary() ([]byte, error) {
+	w := &binaryWriter{}
+	w.buf.WriteString(snapshotMagic)
+	w.buf.WriteByte(snapshotVersion)
+
+	w.buf.WriteByte(byte(s.Profile.AddressWidth))
+	w.u32(s.Profile.MemorySize)
+
+	w.u32(s.PC)
+	w.u32(s.SP)
+	w.buf.WriteByte(byte(s.Flags))
+	w.buf.WriteByte(boolByte(s.InterruptsEnabled))
+	w.buf.WriteByte(byte(len(s.Registers)))
+	w.buf.Write(s.Registers)
+
+	w.u32(len(s.Memory))
+	w.buf.Write(s.Memory)
+
+	c := s.Counters
+	for _, v := range []int{s.Steps, c.Cycles, c.Instructions, c.Loads, c.Stores, c.TakenBranches} {
+		w.u64(v)
+	}
+
+	w.buf.WriteByte(byte(s.Reason))
+	w.str(s.Fault)
+
+	w.u16(len(s.Devices))
+	for _, state := range s.Devices {
+		w.buf.WriteByte(boolByte(state != nil))
+		if state != nil {
+			w.u32(len(state))
+			w.buf.Write(state)
+		}
+	}
+
+	if w.err != nil {
+		return nil, w.err
+	}
+	return w.buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a snapshot encoded by MarshalBinary, returning
+// an error wrapping ErrBadSnapshot if data isn't a valid snapshot
+func (s *Snapshot) UnmarshalBinary(data []byte) error {
+	r := &binaryReader{r: bytes.NewReader(data)}
+	magic := r.bytes(len(snapshotMagic) + 1)
+	if r.err != nil || string(magic[:len(snapshotMagic)]) != snapshotMagic {
+		return fmt.Errorf("%w: not a snapshot", ErrBadSnapshot)
+	}
+	if v := magic[len(snapshotMagic)]; v != snapshotVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrBadSnapshot, v)
+	}
+
+	var snap Snapshot
+	snap.Profile.AddressWidth = r.u8()
+	snap.Profile.MemorySize = r.u32()
+
+	snap.PC = r.u32()
+	snap.SP = r.u32()
+	snap.Flags = Flags(r.u8())
+	snap.InterruptsEnabled = r.u8() == 1
+	snap.Registers = r.bytes(r.u8())
+
+	snap.Memory = r.bytes(r.u32())
+
+	c := &snap.Counters
+	for _, v := range []*int{&snap.Steps, &c.Cycles, &c.Instructions, &c.Loads, &c.Stores, &c.TakenBranches} {
+		*v = r.u64()
+	}
+
+	snap.Reason = HaltReason(r.u8())
+	snap.Fault = r.str()
+
+	if n := r.u16(); n > 0 {
+		snap.Devices = make([][]byte, n)
+	}
+	for i := range snap.Devices {
+		if r.u8() == 1 {
+			snap.Devices[i] = r.bytes(r.u32())
+		}
+	}
+
+	if r.err != nil {
+		return fmt.Errorf("%w: %s", ErrBadSnapshot, r.err)
+	}
+	if r.r.Len() != 0 {
+		return fmt.Errorf("%w: %d bytes of trailing data", ErrBadSnapshot, r.r.Len())
+	}
+	if err := snap.Profile.validate(); err != nil {
+		return fmt.Errorf("%w: %s", ErrBadSnapshot, err)
+	}
+	if snap.Reason < Halted || snap.Reason > Paused {
+		return fmt.Errorf("%w: unknown halt reason %d", ErrBadSnapshot, snap.Reason)
+	}
+	*s = snap
+	return nil
+}
+
+func boolByte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// SaveState saves the timer's period and how far through it the timer
+// is, and whether an interrupt is pending
+func (t *Timer) SaveState() ([]byte, error) {
+	w := &binaryWriter{}
+	w.u32(t.period)
+	w.u32(t.elapsed)
+	w.buf.WriteByte(boolByte(t.pending))
+	return w.buf.Bytes(), w.err
+}
+
+func (t *Timer) RestoreState(state []byte) error {
+	r := &binaryReader{r: bytes.NewReader(state)}
+	period, elapsed, pending := r.u32(), r.u32(), r.u8() == 1
+	if r.err != nil || r.r.Len() != 0 {
+		return errors.New("invalid timer state")
+	}
+	t.period, t.elapsed, t.pending = period, elapsed, pending
+	return nil
+}
+
+// SaveState saves the byte the stream has read ahead of the program, if
+// there is one. A restored stream gives the program that byte next, and
+// then carries on reading from its own reader.
+func (s *InputStream) SaveState() ([]byte, error) {
+	return append([]byte{}, s.peeked...), nil
+}
+
+func (s *InputStream) RestoreState(state []byte) error {
+	if len(state) > 1 {
+		return errors.New("invalid input stream state")
+	}
+	s.peeked = append([]byte(nil), state...)
+	return nil
+}
+
+// SaveState saves the count, and the value latched by the last read
+func (c *CycleCounter) SaveState() ([]byte, error) {
+	w := &binaryWriter{}
+	w.u64(int(c.count))
+	w.u64(int(c.latched))
+	return w.buf.Bytes(), w.err
+}
+
+func (c *CycleCounter) RestoreState(state []byte) error {
+	r := &binaryReader{r: bytes.NewReader(state)}
+	count, latched := r.u64(), r.u64()
+	if r.err != nil || r.r.Len() != 0 {
+		return errors.New("invalid cycle counter state")
+	}
+	c.count, c.latched = uint64(count), uint64(latched)
+	return nil
+}
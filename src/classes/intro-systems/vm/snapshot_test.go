@@ -0,0 +1,336 @@
+package vm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newPreempted returns a machine running the preempted program, with a
+// timer and a cycle counter so there's device state to save
+func newPreempted(t *testing.T) *Machine {
+	t.Helper()
+	mc, err := Assemble(preempted)
+	if err != nil {
+		t.Fatalf("failed to assemble: %s", err)
+	}
+	memory := make([]byte, 256)
+	copy(memory[ProgramStart:], mc)
+	memory[2] = 3
+	memory[testVector] = 0x11
+
+	return NewMachine(memory, Options{
+		MaxSteps:        1000,
+		InterruptVector: testVector,
+		Costs:           unitCosts,
+		Devices: []Mapping{
+			{Start: 0xe0, Size: 1, Device: NewTimer(10)},
+			{Start: 0xe8, Size: 8, Device: &CycleCounter{}},
+			{Start: 0xf0, Size: 1, Device: NewConsole(io.Discard)},
+		},
+	})
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// encode round trips the snapshot through one of its encodings
+		encode func(t *testing.T, s *Snapshot) *Snapshot
+	}{
+		{"Snapshot", func(t *testing.T, s *Snapshot) *Snapshot { return s }},
+		{"JSON", func(t *testing.T, s *Snapshot) *Snapshot {
+			data, err := json.Marshal(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got Snapshot
+			if err := json.Unmarshal(data, &got); err != nil {
+				t.Fatal(err)
+			}
+			return &got
+		}},
+		{"Binary", func(t *testing.T, s *Snapshot) *Snapshot {
+			data, err := s.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got Snapshot
+			if err := got.UnmarshalBinary(data); err != nil {
+				t.Fatal(err)
+			}
+			return &got
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// Stop partway through, after the timer has fired once
+			want := newPreempted(t)
+			for i := 0; i < 15; i++ {
+				if err := want.Step(); err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+			}
+			s, err := want.Snapshot()
+			if err != nil {
+				t.Fatalf("failed to snapshot: %s", err)
+			}
+
+			decoded := test.encode(t, s)
+			if !reflect.DeepEqual(decoded, s) {
+				t.Fatalf("got:\n%+v\nwanted:\n%+v", decoded, s)
+			}
+
+			got := newPreempted(t)
+			if err := got.Restore(decoded); err != nil {
+				t.Fatalf("failed to restore: %s", err)
+			}
+			if !reflect.DeepEqual(got.Result(), want.Result()) {
+				t.Fatalf("restored to:\n%+v\nwanted:\n%+v", got.Result(), want.Result())
+			}
+
+			// Both machines carry on to the same end
+			for _, m := range []*Machine{want, got} {
+				if err := m.Continue(context.Background()); err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+			}
+			if !reflect.DeepEqual(got.Result(), want.Result()) {
+				t.Errorf("finished with:\n%+v\nwanted:\n%+v", got.Result(), want.Result())
+			}
+			if !reflect.DeepEqual(got.Memory(), want.Memory()) {
+				t.Errorf("memory differs after finishing")
+			}
+		})
+	}
+}
+
+func TestSnapshotVariants(t *testing.T) {
+	mc, err := Assemble(`
+	load r1 1
+	load r2 2
+	add r1 r2
+	store r1 0
+	halt`)
+	if err != nil {
+		t.Fatalf("failed to assemble: %s", err)
+	}
+	memory := make([]byte, 256)
+	copy(memory[ProgramStart:], mc)
+	memory[1], memory[2] = 3, 4
+
+	m := NewMachine(memory, Options{})
+	for i := 0; i < 2; i++ {
+		if err := m.Step(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	s, err := m.Snapshot()
+	if err != nil {
+		t.Fatalf("failed to snapshot: %s", err)
+	}
+
+	// Try a few values of r2 from the same point, changing the snapshot
+	// rather than the machine
+	for _, r2 := range []byte{4, 10, 255} {
+		variant := *s
+		variant.Registers = append([]byte(nil), s.Registers...)
+		variant.Registers[2] = r2
+		if err := m.Restore(&variant); err != nil {
+			t.Fatalf("failed to restore: %s", err)
+		}
+		if err := m.Continue(context.Background()); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if want := 3 + r2; memory[0] != want {
+			t.Errorf("with r2 = %d got %d, wanted %d", r2, memory[0], want)
+		}
+		if m.Steps() != 5 {
+			t.Errorf("with r2 = %d took %d steps, wanted 5", r2, m.Steps())
+		}
+	}
+}
+
+func TestSnapshotFaulted(t *testing.T) {
+	memory := make([]byte, 256)
+	memory[ProgramStart] = 0x42
+	m := NewMachine(memory, Options{})
+	fault := m.Step()
+	if fault == nil {
+		t.Fatal("expected a fault")
+	}
+	s, err := m.Snapshot()
+	if err != nil {
+		t.Fatalf("failed to snapshot: %s", err)
+	}
+	if s.Reason != Faulted || s.Fault != fault.Error() {
+		t.Errorf("got %s %q, wanted %s %q", s.Reason, s.Fault, Faulted, fault)
+	}
+
+	restored := NewMachine(make([]byte, 256), Options{})
+	if err := restored.Restore(s); err != nil {
+		t.Fatalf("failed to restore: %s", err)
+	}
+	if err := restored.Step(); err == nil || err.Error() != fault.Error() {
+		t.Errorf("got %v, wanted %q", err, fault)
+	}
+}
+
+func TestRestoreMismatch(t *testing.T) {
+	s, err := NewMachine(make([]byte, 256), Options{}).Snapshot()
+	if err != nil {
+		t.Fatalf("failed to snapshot: %s", err)
+	}
+
+	for _, test := range []struct {
+		name string
+		m    *Machine
+	}{
+		{"Profile", NewMachine(Profile16.NewMemory(), Options{Profile: Profile16})},
+		{"Memory", NewMachine(make([]byte, 128), Options{})},
+		{"Registers", NewMachine(make([]byte, 256), Options{Registers: MaxRegisters})},
+		{"Devices", NewMachine(make([]byte, 256), Options{Devices: []Mapping{{Start: 0xf0, Size: 1, Device: NewConsole(io.Discard)}}})},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.m.Restore(s); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+
+	small := Profile{MemorySize: 128, AddressWidth: 1}
+	want := "snapshot is of a machine with 256 bytes of memory and 1 byte addresses, not 128 bytes of memory and 1 byte addresses"
+	if err := NewMachine(small.NewMemory(), Options{Profile: small}).Restore(s); err == nil || err.Error() != want {
+		t.Errorf("got %v restoring to a different profile, wanted %q", err, want)
+	}
+
+	for _, test := range []struct {
+		name string
+		edit func(s *Snapshot)
+	}{
+		{"NegativePC", func(s *Snapshot) { s.PC = -1 }},
+		{"PCPastTheEnd", func(s *Snapshot) { s.PC = 257 }},
+		{"SPPastTheEnd", func(s *Snapshot) { s.SP = 257 }},
+		{"SPBelowTheStack", func(s *Snapshot) { s.SP = 256 - DefaultStackSize - 1 }},
+		{"Reason", func(s *Snapshot) { s.Reason = Paused + 1 }},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			edited := *s
+			test.edit(&edited)
+			m := NewMachine(make([]byte, 256), Options{})
+			if err := m.Restore(&edited); err == nil {
+				t.Error("expected an error")
+			}
+			if m.PC() != ProgramStart || m.SP() != 256 {
+				t.Errorf("machine changed to pc %d, sp %d", m.PC(), m.SP())
+			}
+		})
+	}
+
+	t.Run("DeviceState", func(t *testing.T) {
+		m := NewMachine(make([]byte, 256), Options{Devices: []Mapping{{Start: 0xe0, Size: 1, Device: NewTimer(5)}}})
+		s, err := m.Snapshot()
+		if err != nil {
+			t.Fatalf("failed to snapshot: %s", err)
+		}
+		s.Devices[0] = []byte{1, 2}
+		if err := m.Restore(s); err == nil {
+			t.Error("expected an error")
+		}
+	})
+}
+
+func TestSnapshotInputStream(t *testing.T) {
+	mc, err := Assemble(`
+	load r1 5      ; InputStatus
+	load r1 4      ; InputPort
+	store r1 0
+	halt`)
+	if err != nil {
+		t.Fatalf("failed to assemble: %s", err)
+	}
+	newMachine := func(input string) *Machine {
+		memory := make([]byte, 256)
+		copy(memory[ProgramStart:], mc)
+		return NewMachine(memory, Options{Devices: StandardDevices(strings.NewReader(input), io.Discard)})
+	}
+
+	// Checking the status reads a byte ahead, which the snapshot must
+	// carry to the restored machine, reading from a different stream
+	for _, test := range []struct {
+		steps int
+		want  byte
+	}{
+		{0, 'x'},
+		{1, 'a'},
+		{2, 'a'},
+	} {
+		steps := test.steps
+		m := newMachine("ab")
+		for i := 0; i < steps; i++ {
+			if err := m.Step(); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+		s, err := m.Snapshot()
+		if err != nil {
+			t.Fatalf("after %d steps failed to snapshot: %s", steps, err)
+		}
+		data, err := json.Marshal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded Snapshot
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatal(err)
+		}
+
+		restored := newMachine("xy")
+		if err := restored.Restore(&decoded); err != nil {
+			t.Fatalf("after %d steps failed to restore: %s", steps, err)
+		}
+		if err := restored.Continue(context.Background()); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if got := restored.Memory()[0]; got != test.want {
+			t.Errorf("after %d steps got %q, wanted %q", steps, got, test.want)
+		}
+	}
+
+	var stream InputStream
+	if err := stream.RestoreState([]byte("ab")); err == nil {
+		t.Error("expected an error restoring more than one byte of input")
+	}
+}
+
+func TestUnmarshalBadSnapshot(t *testing.T) {
+	s, err := NewMachine(make([]byte, 256), Options{}).Snapshot()
+	if err != nil {
+		t.Fatalf("failed to snapshot: %s", err)
+	}
+	data, err := s.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name string
+		data []byte
+	}{
+		{"Empty", nil},
+		{"Magic", append([]byte("VMO"), data[3:]...)},
+		{"Version", append([]byte("VMS\x02"), data[4:]...)},
+		{"Truncated", data[:len(data)-1]},
+		{"Trailing", append(append([]byte(nil), data...), 0)},
+		{"Profile", append([]byte("VMS\x01\x03"), data[5:]...)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var got Snapshot
+			if err := got.UnmarshalBinary(test.data); !errors.Is(err, ErrBadSnapshot) {
+				t.Errorf("got %v, wanted an ErrBadSnapshot", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,6 @@
+; Add two unsigned integers together
+	load r1 1
+	load r2 2
+	add r1 r2
+	store r1 0
+	halt
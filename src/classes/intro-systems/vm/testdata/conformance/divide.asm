@@ -0,0 +1,6 @@
+; Integer division, which faults when dividing by zero
+	load r1 1
+	load r2 2
+	div r1 r2
+	store r1 0
+	halt
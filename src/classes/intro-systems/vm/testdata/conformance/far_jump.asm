@@ -0,0 +1,8 @@
+; Jump beyond the first 256 bytes, which needs 16 bit addresses
+	load r1 1
+	jump far
+.org 0x1234
+far:
+	addi r1 1
+	store r1 0
+	halt
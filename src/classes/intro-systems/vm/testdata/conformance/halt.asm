@@ -0,0 +1,2 @@
+; Do nothing, just halt
+	halt
@@ -0,0 +1,4 @@
+; double r1 in place
+double:
+	add r1 r1
+	ret
@@ -0,0 +1,3 @@
+; Never halts, so always runs out of steps
+loop:
+	jump loop
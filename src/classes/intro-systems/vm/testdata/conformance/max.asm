@@ -0,0 +1,9 @@
+; The larger of the two inputs, as signed numbers
+	load r1 1
+	load r2 2
+	cmp r1 r2
+	bge done
+	load r1 2
+done:
+	store r1 0
+	halt
@@ -0,0 +1,11 @@
+; Quadruple the first input with a subroutine from another file, run
+; from an entry point after it
+.entry main
+.include "lib/double.asm"
+
+main:
+	load r1 1
+	call double
+	call double
+	store r1 0
+	halt
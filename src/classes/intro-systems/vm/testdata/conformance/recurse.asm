@@ -0,0 +1,3 @@
+; Unbounded recursion overflows the stack
+f:
+	call f
@@ -0,0 +1,6 @@
+; Subtract the second input from the first
+	load r1 1
+	load r2 2
+	sub r1 r2
+	store r1 0
+	halt
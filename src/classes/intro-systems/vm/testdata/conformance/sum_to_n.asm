@@ -0,0 +1,10 @@
+; Sum the numbers from 1 up to the first input
+	load r1 1
+loop:
+	beqz r1 done
+	add r2 r1
+	subi r1 1
+	jump loop
+done:
+	store r2 0
+	halt
@@ -0,0 +1,8 @@
+; Add a constant laid out after the code to the first input
+.org 8
+	load r1 1
+	load r2 table
+	add r1 r2
+	store r1 0
+	halt
+table: .byte 100
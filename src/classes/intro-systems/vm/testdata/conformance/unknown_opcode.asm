@@ -0,0 +1,4 @@
+; Running data faults
+	load r1 1
+	.byte 0x42
+	halt
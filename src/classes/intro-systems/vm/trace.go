@@ -0,0 +1,177 @@
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Tracer is notified around every instruction a machine runs. Before is
+// called once the instruction has been fetched, and After once it has
+// run (or faulted), with the effects it had filled in.
+type Tracer interface {
+	Before(e Event)
+	After(e Event)
+}
+
+// Event describes a single instruction run by the machine
+type Event struct {
+	Step     int    `json:"step"`
+	PC       int    `json:"pc"`
+	Op       byte   `json:"op"`
+	Mnemonic string `json:"mnemonic,omitempty"`
+	Operands []int  `json:"operands,omitempty"`
+	// Text is the instruction as it would be written in assembly
+	Text string `json:"text,omitempty"`
+	// Symbol and Source locate the instruction in the program's source,
+	// if it was loaded from an Object, for example "loop+3" and
+	// "prog.asm:12"
+	Symbol string `json:"symbol,omitempty"`
+	Source string `json:"source,omitempty"`
+
+	// The following are only filled in for After
+
+	NextPC    int              `json:"next_pc"`
+	Registers []RegisterChange `json:"registers,omitempty"`
+	Writes    []MemoryWrite    `json:"writes,omitempty"`
+	Err       error            `json:"-"`
+}
+
+// RegisterChange records a register whose value was changed by an
+// instruction. Changes to the PC are reported as Event.NextPC instead.
+type RegisterChange struct {
+	Reg int  `json:"reg"`
+	Old byte `json:"old"`
+	New byte `json:"new"`
+}
+
+// MemoryWrite records a byte of memory written by an instruction. Writes
+// to a mapped device are marked as such, and have no old value.
+type MemoryWrite struct {
+	Addr   int  `json:"addr"`
+	Old    byte `json:"old"`
+	New    byte `json:"new"`
+	Device bool `json:"device,omitempty"`
+}
+
+// newEvent decodes the instruction at pc, as far as possible, for
+// reporting to a Tracer
+func (m *Machine) newEvent() *Event {
+	pc := m.PC()
+	e := &Event{Step: m.steps, PC: pc}
+	if o := m.opts.Object; o != nil {
+		e.Symbol = o.SymbolAt(pc)
+		if l, ok := o.LineAt(pc); ok {
+			e.Source = l.String()
+		}
+	}
+	if pc < 0 || pc >= len(m.memory) {
+		return e
+	}
+
+	e.Op = m.memory[pc]
+	in, ok := opcodes[e.Op]
+	if !ok || pc+m.profile.size(in) > len(m.memory) {
+		return e
+	}
+
+	raw := m.memory[pc : pc+m.profile.size(in)]
+	e.Mnemonic = in.mnemonic
+	e.Operands = m.profile.decode(in, raw)
+	e.Text, _ = format(m.profile, in, raw, pc)
+	return e
+}
+
+// finishEvent fills in the effects of the instruction described by e,
+// given the registers from before it ran
+func (m *Machine) finishEvent(e *Event, before []byte, err error) {
+	e.NextPC = m.PC()
+	e.Err = err
+	for r := 1; r < len(before); r++ {
+		if before[r] != m.registers[r] {
+			e.Registers = append(e.Registers, RegisterChange{Reg: r, Old: before[r], New: m.registers[r]})
+		}
+	}
+}
+
+// TextTracer writes one human readable line per instruction, for
+// example:
+//
+//	$ vm run -trace text prog.asm
+//	     3  0x11  subi r1 1          r1=4 (was 5)
+//
+// If the program was loaded from an Object, each label is written on a
+// line of its own as it's reached, and instructions are followed by the
+// source line they came from:
+//
+//	loop:
+//	     2  0x0e  beqz r1 5          ; prog.asm:4
+type TextTracer struct {
+	w io.Writer
+}
+
+// NewTextTracer returns a tracer that writes to w
+func NewTextTracer(w io.Writer) *TextTracer {
+	return &TextTracer{w: w}
+}
+
+func (t *TextTracer) Before(e Event) {}
+
+func (t *TextTracer) After(e Event) {
+	text := e.Text
+	if text == "" {
+		text = fmt.Sprintf(".byte 0x%02x", e.Op)
+	}
+
+	var effects []string
+	for _, r := range e.Registers {
+		effects = append(effects, fmt.Sprintf("%s=%d (was %d)", registerName(byte(r.Reg)), r.New, r.Old))
+	}
+	for _, w := range e.Writes {
+		if w.Device {
+			effects = append(effects, fmt.Sprintf("[%d]<-%d", w.Addr, w.New))
+			continue
+		}
+		effects = append(effects, fmt.Sprintf("[%d]=%d (was %d)", w.Addr, w.New, w.Old))
+	}
+	if e.Err != nil {
+		effects = append(effects, "fault: "+e.Err.Error())
+	}
+	if e.Source != "" {
+		effects = append(effects, "; "+e.Source)
+	}
+
+	if e.Symbol != "" && !strings.Contains(e.Symbol, "+") {
+		fmt.Fprintf(t.w, "%s:\n", e.Symbol)
+	}
+	line := fmt.Sprintf("%6d  0x%02x  %-18s %s", e.Step, e.PC, text, strings.Join(effects, " "))
+	fmt.Fprintln(t.w, strings.TrimRight(line, " "))
+}
+
+// JSONTracer writes one JSON object per instruction (JSON lines), in the
+// shape of Event with an additional "fault" field if the instruction
+// faulted
+type JSONTracer struct {
+	enc *json.Encoder
+}
+
+// NewJSONTracer returns a tracer that writes to w
+func NewJSONTracer(w io.Writer) *JSONTracer {
+	return &JSONTracer{enc: json.NewEncoder(w)}
+}
+
+func (t *JSONTracer) Before(e Event) {}
+
+func (t *JSONTracer) After(e Event) {
+	line := struct {
+		Event
+		Fault string `json:"fault,omitempty"`
+	}{Event: e}
+	if e.Err != nil {
+		line.Fault = e.Err.Error()
+	}
+	// There's nowhere sensible to report a failed write to, and the
+	// trace is best effort anyway
+	_ = t.enc.Encode(line)
+}
@@ -0,0 +1,104 @@
+package vm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type recordingTracer struct {
+	before, after []Event
+}
+
+func (r *recordingTracer) Before(e Event) { r.before = append(r.before, e) }
+func (r *recordingTracer) After(e Event)  { r.after = append(r.after, e) }
+
+const traceProgram = `
+	load r1 1
+	addi r1 2
+	store r1 0
+	halt`
+
+func runTraced(t *testing.T, tracer Tracer) {
+	t.Helper()
+
+	m := newTestMachine(t, traceProgram, 5, 0)
+	m.opts.Tracer = tracer
+	if err := m.Continue(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestTracer(t *testing.T) {
+	tracer := &recordingTracer{}
+	runTraced(t, tracer)
+
+	if len(tracer.before) != 4 || len(tracer.after) != 4 {
+		t.Fatalf("got %d befores and %d afters, wanted 4 of each", len(tracer.before), len(tracer.after))
+	}
+
+	before := tracer.before[1]
+	if before.PC != 0x0b || before.Mnemonic != "addi" || !reflect.DeepEqual(before.Operands, []int{1, 2}) || before.Registers != nil {
+		t.Errorf("unexpected before event: %+v", before)
+	}
+
+	want := []Event{
+		{Step: 0, PC: 0x08, Op: Load, Mnemonic: "load", Operands: []int{1, 1}, Text: "load r1 1", NextPC: 0x0b,
+			Registers: []RegisterChange{{Reg: 1, Old: 0, New: 5}}},
+		{Step: 1, PC: 0x0b, Op: Addi, Mnemonic: "addi", Operands: []int{1, 2}, Text: "addi r1 2", NextPC: 0x0e,
+			Registers: []RegisterChange{{Reg: 1, Old: 5, New: 7}}},
+		{Step: 2, PC: 0x0e, Op: Store, Mnemonic: "store", Operands: []int{1, 0}, Text: "store r1 0", NextPC: 0x11,
+			Writes: []MemoryWrite{{Addr: 0, Old: 0, New: 7}}},
+		{Step: 3, PC: 0x11, Op: Halt, Mnemonic: "halt", Text: "halt", NextPC: 0x11},
+	}
+	if !reflect.DeepEqual(tracer.after, want) {
+		t.Errorf("got:\n%+v\nwanted:\n%+v", tracer.after, want)
+	}
+}
+
+func TestTextTracer(t *testing.T) {
+	var out bytes.Buffer
+	runTraced(t, NewTextTracer(&out))
+
+	want := strings.Join([]string{
+		"     0  0x08  load r1 1          r1=5 (was 0)",
+		"     1  0x0b  addi r1 2          r1=7 (was 5)",
+		"     2  0x0e  store r1 0         [0]=7 (was 0)",
+		"     3  0x11  halt",
+		"",
+	}, "\n")
+	if out.String() != want {
+		t.Errorf("got:\n%s\nwanted:\n%s", out.String(), want)
+	}
+}
+
+func TestJSONTracer(t *testing.T) {
+	var out bytes.Buffer
+	runTraced(t, NewJSONTracer(&out))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("got %d lines, wanted 4", len(lines))
+	}
+
+	var e Event
+	if err := json.Unmarshal([]byte(lines[2]), &e); err != nil {
+		t.Fatalf("failed to parse %q: %s", lines[2], err)
+	}
+	if e.Mnemonic != "store" || len(e.Writes) != 1 || e.Writes[0] != (MemoryWrite{Addr: 0, Old: 0, New: 7}) {
+		t.Errorf("unexpected event: %+v", e)
+	}
+}
+
+func TestTracerFault(t *testing.T) {
+	var out bytes.Buffer
+	m := NewMachine([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0x42}, Options{Tracer: NewJSONTracer(&out)})
+	_ = m.Step()
+
+	if !strings.Contains(out.String(), `"fault":"unknown instruction 0x42 at memory location 8"`) {
+		t.Errorf("expected the fault to be traced, got: %s", out.String())
+	}
+}
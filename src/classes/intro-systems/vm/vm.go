@@ -1,11 +1,14 @@
 package vm
 
 import (
-	"encoding/hex"
+	"context"
 	"fmt"
 	"os"
 )
 
+// Every instruction's register operand comes first, so load and store
+// are both encoded as the opcode, then the register, then the address:
+// load r3 1 is 01 03 01.
 const (
 	Load  = 0x01
 	Store = 0x02
@@ -22,96 +25,694 @@ const (
 	Beqz = 0x08
 )
 
-// Given a 256 byte array of "memory", run the stored program
-// to completion, modifying the data in place to reflect the result
-//
-// The memory format is:
-//
-// 00 01 02 03 04 05 06 07 08 09 0a 0b 0c 0d 0e 0f ... ff
-// __ __ __ __ __ __ __ __ __ __ __ __ __ __ __ __ ... __
-// ^==DATA===============^ ^==INSTRUCTIONS==============^
-//
-func compute(memory []byte) {
-	registers := [3]byte{8, 0, 0} // PC, R1 and R2
+// Arithmetic and bitwise operations. All but Not take two registers and
+// store the result in the first.
+const (
+	Mul = 0x09
+	Div = 0x0a
+	Mod = 0x0b
+	And = 0x0c
+	Or  = 0x0d
+	Xor = 0x0e
+	Not = 0x0f
+	Shl = 0x10
+	Shr = 0x11
+)
+
+// Stack operations. The stack lives at the top of memory and grows
+// down, and call pushes the address of the following instruction for
+// ret to pop.
+const (
+	Push = 0x12
+	Pop  = 0x13
+	Call = 0x14
+	Ret  = 0x15
+)
+
+// Comparisons and conditional branches. Cmp sets the flags as if the
+// second register were subtracted from the first, and each branch takes
+// a signed offset from the end of the branch instruction.
+const (
+	Cmp  = 0x16
+	Beq  = 0x17
+	Bne  = 0x18
+	Blt  = 0x19
+	Bge  = 0x1a
+	Bltu = 0x1b
+	Bgeu = 0x1c
+)
+
+// Interrupts. Ei and Di enable and disable interrupts, and Iret returns
+// from an interrupt handler, see Options.InterruptVector.
+const (
+	Ei   = 0x1d
+	Di   = 0x1e
+	Iret = 0x1f
+)
+
+// Flags are the condition flags, set by cmp as well as by add, sub, addi
+// and subi
+type Flags byte
+
+const (
+	// The result was zero
+	FlagZ Flags = 1 << iota
+	// The result carried out of (for addition), or borrowed into (for
+	// subtraction) the top bit, i.e. it overflowed as an unsigned number
+	FlagC
+	// The top bit of the result is set, i.e. it's negative as a signed
+	// number
+	FlagN
+	// The result overflowed as a signed number
+	FlagV
+)
+
+func (f Flags) String() string {
+	b := []byte("----")
+	for i, c := range "ZCNV" {
+		if f&(1<<i) != 0 {
+			b[i] = byte(c)
+		}
+	}
+	return string(b)
+}
+
+// ProgramStart is the address of the first instruction, immediately
+// after the data region
+const ProgramStart = 0x08
+
+// HaltReason describes why a program stopped running
+type HaltReason int
+
+const (
+	// The program ran a halt instruction
+	Halted HaltReason = iota
+	// The program was stopped by a fault, see the accompanying error
+	Faulted
+	// The program ran out of steps, or its context was cancelled
+	BudgetExhausted
+	// The program hasn't finished, it was stopped by a debugger
+	Paused
+)
+
+func (r HaltReason) String() string {
+	switch r {
+	case Halted:
+		return "halted"
+	case Faulted:
+		return "faulted"
+	case BudgetExhausted:
+		return "budget exhausted"
+	case Paused:
+		return "paused"
+	default:
+		return fmt.Sprintf("HaltReason(%d)", int(r))
+	}
+}
+
+// DefaultRegisters is the number of general purpose registers a machine
+// has unless Options.Registers says otherwise
+const DefaultRegisters = 8
+
+// MaxRegisters is the most general purpose registers a machine can be
+// configured with
+const MaxRegisters = 16
+
+// DefaultStackSize is the number of bytes at the top of memory set aside
+// for the stack unless Options.StackSize says otherwise
+const DefaultStackSize = 16
+
+// Result describes the state of the machine once a program stops
+type Result struct {
+	// PC is the address of the instruction the machine stopped at
+	PC int
+	// SP is the address of the value on top of the stack, or the end of
+	// memory if the stack is empty
+	SP    int
+	Flags Flags
+	// Registers are indexed by register number, so Registers[1] is r1.
+	// There is no r0, so Registers[0] is always zero.
+	Registers []byte
+	// Steps is the number of instructions executed, including the
+	// final halt
+	Steps  int
+	Reason HaltReason
+	// InterruptsEnabled is set if the machine would take an interrupt
+	InterruptsEnabled bool
+	Counters          Counters
+	// Caches has the statistics for each level of Options.Caches
+	Caches []CacheStats
+}
+
+// ErrUnknownOpcode is returned when the program counter points at a
+// byte that is not a known instruction
+type ErrUnknownOpcode struct {
+	Op byte
+	PC int
+}
+
+func (e ErrUnknownOpcode) Error() string {
+	return fmt.Sprintf("unknown instruction 0x%02x at memory location %d", e.Op, e.PC)
+}
+
+// ErrPCOutOfBounds is returned when an instruction (or one of its
+// operands) would be fetched from beyond the end of memory
+type ErrPCOutOfBounds struct {
+	PC int
+}
+
+func (e ErrPCOutOfBounds) Error() string {
+	return fmt.Sprintf("instruction at memory location %d runs past the end of memory", e.PC)
+}
+
+// ErrInvalidRegister is returned when an instruction refers to a
+// register the machine doesn't have
+type ErrInvalidRegister struct {
+	Reg byte
+	PC  int
+}
+
+func (e ErrInvalidRegister) Error() string {
+	return fmt.Sprintf("invalid register %d at memory location %d", e.Reg, e.PC)
+}
+
+// ErrDivideByZero is returned by div and mod when the divisor is zero
+type ErrDivideByZero struct {
+	PC int
+}
+
+func (e ErrDivideByZero) Error() string {
+	return fmt.Sprintf("divide by zero at memory location %d", e.PC)
+}
+
+// ErrStackOverflow is returned when pushing onto a full stack
+type ErrStackOverflow struct {
+	SP int
+	PC int
+}
+
+func (e ErrStackOverflow) Error() string {
+	return fmt.Sprintf("stack overflow (sp=%d) at memory location %d", e.SP, e.PC)
+}
+
+// ErrStackUnderflow is returned when popping from an empty stack
+type ErrStackUnderflow struct {
+	SP int
+	PC int
+}
+
+func (e ErrStackUnderflow) Error() string {
+	return fmt.Sprintf("stack underflow (sp=%d) at memory location %d", e.SP, e.PC)
+}
+
+// ErrAddressOutOfBounds is returned when a load or store refers to an
+// address beyond the end of memory
+type ErrAddressOutOfBounds struct {
+	Addr int
+	PC   int
+}
+
+func (e ErrAddressOutOfBounds) Error() string {
+	return fmt.Sprintf("address %d is out of bounds (at memory location %d)", e.Addr, e.PC)
+}
+
+// ErrBudgetExhausted is returned when a program is stopped before it
+// halts, either because it used up its step budget or because its
+// context was cancelled (in which case Err is the context's error).
+type ErrBudgetExhausted struct {
+	PC    int
+	Steps int
+	Err   error
+}
+
+func (e ErrBudgetExhausted) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("stopped at memory location %d after %d steps: %s", e.PC, e.Steps, e.Err)
+	}
+	return fmt.Sprintf("step budget exhausted at memory location %d after %d steps", e.PC, e.Steps)
+}
+
+func (e ErrBudgetExhausted) Unwrap() error {
+	return e.Err
+}
+
+// Options control how a program is run
+type Options struct {
+	// MaxSteps is the most instructions that will be executed before
+	// giving up. Zero means no limit.
+	MaxSteps int
+	// Tracer, if set, is called around every instruction
+	Tracer Tracer
+	// Registers is the number of general purpose registers, r1 up to
+	// r<Registers>. Zero means DefaultRegisters, and it can be at most
+	// MaxRegisters.
+	Registers int
+	// StackSize is the number of bytes at the top of memory that the
+	// stack may grow into. Zero means DefaultStackSize.
+	StackSize int
+	// Profile determines how wide addresses are. The zero value means
+	// Profile8. Memory doesn't have to be Profile.MemorySize bytes, but
+	// any more than can be addressed is unusable.
+	Profile Profile
+	// Regions, if set, turns on memory protection: each instruction
+	// must be executable, loads and pops must be readable, and stores
+	// and pushes must be writable, or the machine faults with an
+	// ErrProtection. Addresses outside every region can't be accessed at
+	// all. See DefaultRegions for the usual layout.
+	Regions []Region
+	// Devices are mapped over memory, so that loads and stores to their
+	// addresses go to the device instead. See StandardDevices.
+	Devices []Mapping
+	// InterruptVector is the address of the word holding the address
+	// of the interrupt handler. When interrupts are enabled and a
+	// device raises one, the machine pushes the PC and then the flags,
+	// disables interrupts and jumps to the handler before running the
+	// next instruction. Zero means interrupts are never delivered. The
+	// vector must be in ordinary memory, not in the bytes reserved for
+	// device ports or overlapping any of Devices.
+	InterruptVector int
+	// Costs gives the number of cycles each opcode takes, for
+	// Result.Counters and for devices that keep time. Nil means
+	// DefaultCosts, and opcodes that aren't listed cost one cycle (so
+	// an empty map makes every instruction a single cycle).
+	Costs map[byte]int
+	// Caches, if set, places a hierarchy of caches between the CPU and
+	// memory, starting with the level closest to the CPU. They only
+	// gather statistics, see Result.Caches.
+	Caches []CacheConfig
+	// Entry is the address of the first instruction to run. Zero means
+	// ProgramStart, so a program can't start at address 0.
+	Entry int
+	// Object is the object the program was loaded from, if any. Trace
+	// events are labelled with its symbols and source lines.
+	Object *Object
+}
+
+// Run the program stored in memory (see compute for the layout) until
+// it halts or faults. Memory is modified in place, and the final state
+// of the machine is returned either way.
+func Run(memory []byte) (Result, error) {
+	return RunContext(context.Background(), memory, Options{})
+}
+
+// RunContext is like Run, but stops early with an ErrBudgetExhausted if
+// ctx is cancelled or the program uses up opts.MaxSteps. If opts are
+// invalid it returns an error wrapping ErrInvalidOptions without running
+// anything.
+func RunContext(ctx context.Context, memory []byte, opts Options) (Result, error) {
+	if err := opts.validate(len(memory)); err != nil {
+		return Result{}, err
+	}
+	m := NewMachine(memory, opts)
+	err := m.Continue(ctx)
+	return m.Result(), err
+}
+
+// fetch decodes the instruction at pc, checking that it can be run and
+// that its operands are valid. It returns the opcode, the operands and
+// the address of the following instruction.
+func (m *Machine) fetch(pc int) (byte, []int, int, error) {
+	memory := m.memory
+	if pc < 0 || pc >= len(memory) {
+		return 0, nil, 0, ErrPCOutOfBounds{PC: pc}
+	}
+	if err := m.check(pc, 1, PermExec); err != nil {
+		return 0, nil, 0, err
+	}
+
+	op := memory[pc]
+	in, ok := opcodes[op]
+	if !ok {
+		return 0, nil, 0, ErrUnknownOpcode{Op: op, PC: pc}
+	}
+	next := pc + m.profile.size(in)
+	if next > len(memory) {
+		return 0, nil, 0, ErrPCOutOfBounds{PC: pc}
+	}
+	if err := m.check(pc, next-pc, PermExec); err != nil {
+		return 0, nil, 0, err
+	}
+	m.touch(0, pc, next-pc)
+
+	args := m.profile.decode(in, memory[pc:next])
+	for i, kind := range in.operands {
+		if r := args[i]; kind == regOperand && (r == 0 || r >= len(m.registers)) {
+			return 0, nil, 0, ErrInvalidRegister{Reg: byte(r), PC: pc}
+		}
+		if a := args[i]; kind == addrOperand && in.accessesMemory() && a >= len(memory) {
+			return 0, nil, 0, ErrAddressOutOfBounds{Addr: a, PC: pc}
+		}
+	}
+	return op, args, next, nil
+}
+
+// step fetches, decodes and executes a single instruction, reporting
+// whether it was a halt
+func (m *Machine) step() (bool, error) {
+	registers := m.registers
+
+	pc := m.pc
+	op, args, next, err := m.fetch(pc)
+	if err != nil {
+		return false, err
+	}
+
+	// decode and execute
+	switch op {
+	case Load:
+		to, from := args[0], args[1]
+		if err := m.check(from, 1, PermRead); err != nil {
+			return false, err
+		}
+
+		v, err := m.read(from)
+		if err != nil {
+			return false, err
+		}
+
+		m.pc = next
+		registers[to] = v
+
+	case Store:
+		from, to := args[0], args[1]
+		if err := m.check(to, 1, PermWrite); err != nil {
+			return false, err
+		}
+
+		if err := m.write(to, registers[from]); err != nil {
+			return false, err
+		}
+		m.pc = next
+
+	case Add:
+		m.pc = next
+
+		r1, r2 := args[0], args[1]
+
+		registers[r1], m.flags = add(registers[r1], registers[r2])
+
+	case Addi:
+		m.pc = next
+
+		r1, n := args[0], byte(args[1])
+
+		registers[r1], m.flags = add(registers[r1], n)
+
+	case Sub:
+		m.pc = next
 
-	// Keep looping, like a physical computer's clock
-	for {
-		pc := registers[0]
+		r1, r2 := args[0], args[1]
 
-		op := memory[pc]
+		registers[r1], m.flags = sub(registers[r1], registers[r2])
 
-		// // decode and execute
-		switch op {
-		case Load:
-			registers[0] = pc + 3
+	case Subi:
+		m.pc = next
 
-			from := memory[pc+1]
-			to := memory[pc+2]
+		r1, n := args[0], byte(args[1])
 
-			registers[to] = memory[from]
+		registers[r1], m.flags = sub(registers[r1], n)
 
-		case Store:
-			registers[0] = pc + 3
+	case Mul, Div, Mod, And, Or, Xor, Shl, Shr:
+		r1, r2 := args[0], args[1]
+		if (op == Div || op == Mod) && registers[r2] == 0 {
+			return false, ErrDivideByZero{PC: pc}
+		}
+
+		m.pc = next
+		registers[r1] = alu(op, registers[r1], registers[r2])
+
+	case Not:
+		m.pc = next
 
-			from := memory[pc+1]
-			to := memory[pc+2]
+		r := args[0]
+
+		registers[r] = ^registers[r]
+
+	case Push:
+		r := args[0]
+		if err := m.push(registers[r]); err != nil {
+			return false, err
+		}
 
-			memory[to] = registers[from]
+		m.pc = next
 
-		case Add:
-			registers[0] = pc + 3
+	case Pop:
+		r := args[0]
+		v, err := m.pop()
+		if err != nil {
+			return false, err
+		}
 
-			r1 := memory[pc+1]
-			r2 := memory[pc+2]
+		m.pc = next
+		registers[r] = v
 
-			registers[r1] += registers[r2]
+	case Call:
+		if err := m.pushAddr(next); err != nil {
+			return false, err
+		}
 
-		case Addi:
-			registers[0] = pc + 3
+		m.pc = args[0]
 
-			r1 := memory[pc+1]
-			n := memory[pc+2]
+	case Ret:
+		addr, err := m.popAddr()
+		if err != nil {
+			return false, err
+		}
 
-			registers[r1] += n
+		m.pc = addr
 
-		case Sub:
-			registers[0] = pc + 3
+	case Cmp:
+		m.pc = next
 
-			r1 := memory[pc+1]
-			r2 := memory[pc+2]
+		r1, r2 := args[0], args[1]
 
-			registers[r1] -= registers[r2]
+		_, m.flags = sub(registers[r1], registers[r2])
 
-		case Subi:
-			registers[0] = pc + 3
+	case Ei, Di:
+		m.pc = next
+		m.interrupts = op == Ei
 
-			r1 := memory[pc+1]
-			n := memory[pc+2]
+	case Iret:
+		flags, err := m.pop()
+		if err != nil {
+			return false, err
+		}
+		addr, err := m.popAddr()
+		if err != nil {
+			return false, err
+		}
 
-			registers[r1] -= n
+		m.pc = addr
+		m.flags = Flags(flags)
+		m.interrupts = true
 
-		case Jump:
-			next := memory[pc+1]
+	case Beq, Bne, Blt, Bge, Bltu, Bgeu:
+		m.pc = next
 
-			registers[0] = next
+		if m.flags.taken(op) {
+			offset := int8(args[0])
+			m.pc += int(offset)
+			m.counters.TakenBranches++
+		}
 
-		case Beqz:
-			registers[0] = pc + 3
+	case Jump:
+		m.pc = args[0]
 
-			r := memory[pc+1]
-			value := registers[r]
+	case Beqz:
+		m.pc = next
+
+		r := args[0]
+		value := registers[r]
+
+		if value == 0 {
+			offset := args[1]
+			m.pc += offset
+			m.counters.TakenBranches++
+		}
+
+	case Halt:
+		m.retire(op)
+		return true, nil
+	}
+
+	m.retire(op)
+	return false, nil
+}
+
+// push a byte onto the stack
+func (m *Machine) push(v byte) error {
+	if m.sp-1 < m.stackBase {
+		return ErrStackOverflow{SP: m.sp, PC: m.pc}
+	}
+	if err := m.check(m.sp-1, 1, PermWrite); err != nil {
+		return err
+	}
+	if err := m.write(m.sp-1, v); err != nil {
+		return err
+	}
+	m.sp--
+	return nil
+}
 
-			if value == 0 {
-				offset := memory[pc+2]
-				registers[0] += offset
-			}
+// pop a byte off the stack
+func (m *Machine) pop() (byte, error) {
+	if m.sp >= len(m.memory) {
+		return 0, ErrStackUnderflow{SP: m.sp, PC: m.pc}
+	}
+	if err := m.check(m.sp, 1, PermRead); err != nil {
+		return 0, err
+	}
+	v, err := m.read(m.sp)
+	if err != nil {
+		return 0, err
+	}
+	m.sp++
+	return v, nil
+}
 
-		case Halt:
-			return
+// pushAddr pushes an address onto the stack, taking up as many bytes as
+// the profile's addresses do. Either all of it is pushed, or none of it.
+func (m *Machine) pushAddr(addr int) error {
+	if m.sp-m.profile.AddressWidth < m.stackBase {
+		return ErrStackOverflow{SP: m.sp, PC: m.pc}
+	}
+	if err := m.check(m.sp-m.profile.AddressWidth, m.profile.AddressWidth, PermWrite); err != nil {
+		return err
+	}
+	// push the high byte first, so the address is little endian in
+	// memory
+	for b := m.profile.AddressWidth - 1; b >= 0; b-- {
+		if err := m.write(m.sp-1, byte(addr>>(8*b))); err != nil {
+			return err
+		}
+		m.sp--
+	}
+	return nil
+}
 
-		default:
-			fmt.Fprintf(os.Stderr, "unknown instruction 0x%s at memory location %d - halting\n", hex.EncodeToString([]byte{op}), pc)
-			return
+// popAddr pops an address pushed by pushAddr
+func (m *Machine) popAddr() (int, error) {
+	if m.sp+m.profile.AddressWidth > len(m.memory) {
+		return 0, ErrStackUnderflow{SP: m.sp, PC: m.pc}
+	}
+	if err := m.check(m.sp, m.profile.AddressWidth, PermRead); err != nil {
+		return 0, err
+	}
+	addr := 0
+	for b := 0; b < m.profile.AddressWidth; b++ {
+		v, err := m.read(m.sp + b)
+		if err != nil {
+			return 0, err
 		}
+		addr |= int(v) << (8 * b)
+	}
+	m.sp += m.profile.AddressWidth
+	return addr, nil
+}
+
+// add returns a + b, along with the flags describing the result
+func add(a, b byte) (byte, Flags) {
+	res := a + b
+
+	var f Flags
+	if res < a {
+		f |= FlagC
+	}
+	// Both inputs had the same sign, but the result doesn't
+	if (a^res)&(b^res)&0x80 != 0 {
+		f |= FlagV
+	}
+	return res, f | signFlags(res)
+}
+
+// sub returns a - b, along with the flags describing the result
+func sub(a, b byte) (byte, Flags) {
+	res := a - b
+
+	var f Flags
+	if a < b {
+		f |= FlagC
+	}
+	// The inputs had different signs, and the result has the sign of b
+	if (a^b)&(a^res)&0x80 != 0 {
+		f |= FlagV
+	}
+	return res, f | signFlags(res)
+}
+
+func signFlags(res byte) Flags {
+	var f Flags
+	if res == 0 {
+		f |= FlagZ
+	}
+	if res&0x80 != 0 {
+		f |= FlagN
+	}
+	return f
+}
+
+// taken reports whether the conditional branch op should be taken given
+// the current flags
+func (f Flags) taken(op byte) bool {
+	z, c := f&FlagZ != 0, f&FlagC != 0
+	n, v := f&FlagN != 0, f&FlagV != 0
+
+	switch op {
+	case Beq:
+		return z
+	case Bne:
+		return !z
+	case Blt:
+		return n != v
+	case Bge:
+		return n == v
+	case Bltu:
+		return c
+	case Bgeu:
+		return !c
+	}
+	panic(fmt.Sprintf("vm: 0x%02x is not a conditional branch", op))
+}
+
+// alu computes the result of a two register arithmetic or bitwise
+// instruction. Shifting by 8 or more always gives zero.
+func alu(op, a, b byte) byte {
+	switch op {
+	case Mul:
+		return a * b
+	case Div:
+		return a / b
+	case Mod:
+		return a % b
+	case And:
+		return a & b
+	case Or:
+		return a | b
+	case Xor:
+		return a ^ b
+	case Shl:
+		return a << b
+	case Shr:
+		return a >> b
+	}
+	panic(fmt.Sprintf("vm: 0x%02x is not an alu instruction", op))
+}
+
+// Given a 256 byte array of "memory", run the stored program
+// to completion, modifying the data in place to reflect the result
+//
+// The memory format is:
+//
+// 00 01 02 03 04 05 06 07 08 09 0a 0b 0c 0d 0e 0f ... ff
+// __ __ __ __ __ __ __ __ __ __ __ __ __ __ __ __ ... __
+// ^==DATA===============^ ^==INSTRUCTIONS==============^
+//
+// Byte 0 of the data region is the output and bytes 1 and 2 are the
+// inputs. Bytes 3 to 7 are reserved for device ports (see
+// StandardDevices), so programs mustn't use them for their own data,
+// even when no devices are mapped.
+func compute(memory []byte) {
+	if _, err := Run(memory); err != nil {
+		fmt.Fprintf(os.Stderr, "%s - halting\n", err)
 	}
 }
@@ -1,10 +1,12 @@
 package vm
 
 import (
+	"context"
+	"errors"
 	"os"
-	"strconv"
-	"strings"
+	"reflect"
 	"testing"
+	"time"
 )
 
 type vmCase struct{ x, y, out byte }
@@ -34,6 +36,17 @@ halt`,
 			{255, 0, 255},
 		},
 	},
+	// Registers and addresses are encoded in the order they are written
+	{
+		name: "LoadStoreR2",
+		asm: `
+load r2 1
+store r2 0
+halt`,
+		cases: []vmCase{
+			{7, 0, 7},
+		},
+	},
 	// Add two unsigned integers together
 	{
 		name: "Add",
@@ -121,12 +134,353 @@ halt`,
 			{10, 0, 55},
 		},
 	},
+	// The same program, but with labels instead of hand-computed targets
+	{
+		name: "Sum to n with labels",
+		asm: `
+	load r1 1
+loop:
+	beqz r1 done
+	add r2 r1
+	subi r1 1
+	jump loop
+done:
+	store r2 0
+	halt`,
+		cases: []vmCase{
+			{0, 0, 0},
+			{5, 0, 15},
+			{10, 0, 55},
+		},
+	},
+}
+
+// Arithmetic and bitwise instructions, which are all of the form
+// "op r1 r2", with the result in r1
+var aluTests = []vmTest{
+	{
+		name: "Mul",
+		asm: `
+load r1 1
+load r2 2
+mul r1 r2
+store r1 0
+halt`,
+		cases: []vmCase{
+			{3, 4, 12},
+			{16, 16, 0}, // overflows
+			{255, 255, 1},
+		},
+	},
+	{
+		name: "Div",
+		asm: `
+load r1 1
+load r2 2
+div r1 r2
+store r1 0
+halt`,
+		cases: []vmCase{
+			{12, 4, 3},
+			{13, 4, 3}, // rounds down
+			{3, 4, 0},
+		},
+	},
+	{
+		name: "Mod",
+		asm: `
+load r1 1
+load r2 2
+mod r1 r2
+store r1 0
+halt`,
+		cases: []vmCase{
+			{13, 4, 1},
+			{12, 4, 0},
+			{3, 255, 3},
+		},
+	},
+	{
+		name: "And",
+		asm: `
+load r1 1
+load r2 2
+and r1 r2
+store r1 0
+halt`,
+		cases: []vmCase{
+			{0b1100, 0b1010, 0b1000},
+			{255, 0, 0},
+		},
+	},
+	{
+		name: "Or",
+		asm: `
+load r1 1
+load r2 2
+or r1 r2
+store r1 0
+halt`,
+		cases: []vmCase{
+			{0b1100, 0b1010, 0b1110},
+			{0, 0, 0},
+		},
+	},
+	{
+		name: "Xor",
+		asm: `
+load r1 1
+load r2 2
+xor r1 r2
+store r1 0
+halt`,
+		cases: []vmCase{
+			{0b1100, 0b1010, 0b0110},
+			{42, 42, 0},
+		},
+	},
+	{
+		name: "Not",
+		asm: `
+load r1 1
+not r1
+store r1 0
+halt`,
+		cases: []vmCase{
+			{0, 0, 255},
+			{0b10101010, 0, 0b01010101},
+		},
+	},
+	{
+		name: "Shl",
+		asm: `
+load r1 1
+load r2 2
+shl r1 r2
+store r1 0
+halt`,
+		cases: []vmCase{
+			{1, 3, 8},
+			{0b11000001, 1, 0b10000010}, // high bits fall off
+			{1, 8, 0},
+		},
+	},
+	{
+		name: "Shr",
+		asm: `
+load r1 1
+load r2 2
+shr r1 r2
+store r1 0
+halt`,
+		cases: []vmCase{
+			{8, 3, 1},
+			{0b10000011, 1, 0b01000001}, // logical, not arithmetic
+			{255, 200, 0},
+		},
+	},
+	// Output 1 if the input is odd, without a loop
+	{
+		name: "Parity",
+		asm: `
+load r1 1
+addi r2 1
+and r1 r2
+store r1 0
+halt`,
+		cases: []vmCase{
+			{0, 0, 0},
+			{7, 0, 1},
+			{254, 0, 0},
+		},
+	},
+}
+
+// Subroutines using the stack
+var stackTests = []vmTest{
+	// Swap the inputs by pushing both and popping them in reverse
+	{
+		name: "PushPop",
+		asm: `
+load r1 1
+load r2 2
+push r1
+push r2
+pop r1
+pop r2
+sub r1 r2
+store r1 0
+halt`,
+		cases: []vmCase{
+			{1, 3, 2},
+			{5, 5, 0},
+		},
+	},
+	// Compute 4x by calling a doubling subroutine twice
+	{
+		name: "CallRet",
+		asm: `
+	load r1 1
+	call double
+	call double
+	store r1 0
+	halt
+double:
+	push r2
+	load r2 1     ; clobber r2, which is restored before returning
+	add r1 r1
+	pop r2
+	ret`,
+		cases: []vmCase{
+			{1, 0, 4},
+			{10, 0, 40},
+		},
+	},
+	// Recursively sum 1 to n
+	{
+		name: "Recursion",
+		asm: `
+	load r1 1
+	call sum
+	store r2 0
+	halt
+sum:                ; r2 += r1 + (r1 - 1) + ... + 1
+	beqz r1 base
+	add r2 r1
+	subi r1 1
+	call sum
+base:
+	ret`,
+		cases: []vmCase{
+			{0, 0, 0},
+			{5, 0, 15},
+			{10, 0, 55},
+		},
+	},
+}
+
+// Comparisons and conditional branches
+var branchTests = []vmTest{
+	// Output the larger input, treating them as unsigned
+	{
+		name: "MaxUnsigned",
+		asm: `
+	load r1 1
+	load r2 2
+	cmp r1 r2
+	bgeu done
+	load r1 2
+done:
+	store r1 0
+	halt`,
+		cases: []vmCase{
+			{3, 5, 5},
+			{5, 3, 5},
+			{200, 100, 200},
+		},
+	},
+	// Output the larger input, treating them as signed
+	{
+		name: "MaxSigned",
+		asm: `
+	load r1 1
+	load r2 2
+	cmp r1 r2
+	bge done
+	load r1 2
+done:
+	store r1 0
+	halt`,
+		cases: []vmCase{
+			{3, 5, 5},
+			{200, 100, 100},    // -56 < 100
+			{0x7f, 0x80, 0x7f}, // 127 > -128, which overflows when subtracted
+		},
+	},
+	// Output 1 if the inputs are equal, 2 if x < y (unsigned) and 3
+	// otherwise
+	{
+		name: "Compare",
+		asm: `
+	load r1 1
+	load r2 2
+	cmp r1 r2
+	beq equal
+	bltu less     ; the flags are still set from the cmp
+	addi r3 3
+	jump done
+less:
+	addi r3 2
+	jump done
+equal:
+	addi r3 1
+done:
+	store r3 0
+	halt`,
+		cases: []vmCase{
+			{4, 4, 1},
+			{3, 4, 2},
+			{4, 3, 3},
+			{255, 0, 3},
+		},
+	},
+	// The sum to n loop, using a backward branch instead of a jump
+	{
+		name: "Sum to n with bne",
+		asm: `
+	load r1 1
+	addi r1 0     ; set the flags from r1
+	beq done
+loop:
+	add r2 r1
+	subi r1 1
+	bne loop
+done:
+	store r2 0
+	halt`,
+		cases: []vmCase{
+			{0, 0, 0},
+			{5, 0, 15},
+			{10, 0, 55},
+		},
+	},
+	// Multiply by repeated addition, stopping when the counter carries
+	{
+		name: "Multiply",
+		asm: `
+	load r1 1
+	load r2 2
+	addi r3 1
+	beqz r2 done
+loop:
+	add r4 r1
+	sub r2 r3
+	bgeu loop     ; no borrow, so r2 was at least 1
+	sub r4 r1     ; the loop ran one extra time
+done:
+	store r4 0
+	halt`,
+		cases: []vmCase{
+			{3, 0, 0},
+			{3, 4, 12},
+			{7, 1, 7},
+		},
+	},
 }
 
 func TestCompute(t *testing.T) {
 	for _, test := range mainTests {
 		t.Run(test.name, func(t *testing.T) { testCompute(t, test) })
 	}
+	for _, test := range aluTests {
+		t.Run(test.name, func(t *testing.T) { testCompute(t, test) })
+	}
+	for _, test := range stackTests {
+		t.Run(test.name, func(t *testing.T) { testCompute(t, test) })
+	}
+	for _, test := range branchTests {
+		t.Run(test.name, func(t *testing.T) { testCompute(t, test) })
+	}
 	if os.Getenv("STRETCH") != "true" {
 		println("Skipping stretch goal tests. Run `STRETCH=true go test` to include them.")
 	} else {
@@ -141,14 +495,21 @@ func TestCompute(t *testing.T) {
 // case through the virtual machine
 func testCompute(t *testing.T, test vmTest) {
 	// assemble code and load into memory
+	mc, err := Assemble(test.asm)
+	if err != nil {
+		t.Fatalf("failed to assemble: %s", err)
+	}
 	memory := make([]byte, 256)
-	copy(memory[8:], assemble(test.asm))
+	copy(memory[8:], mc)
 	// for each case, set inputs and run vm
 	for _, c := range test.cases {
 		memory[1] = c.x
 		memory[2] = c.y
 
-		compute(memory)
+		// A bug in the vm (or the program) shouldn't hang the tests
+		if _, err := RunContext(context.Background(), memory, Options{MaxSteps: 10000}); err != nil {
+			t.Fatalf("f(%d, %d) failed: %s", c.x, c.y, err)
+		}
 
 		actual := memory[0]
 		if actual != c.out {
@@ -160,54 +521,286 @@ func testCompute(t *testing.T, test vmTest) {
 	}
 }
 
-func reg(s string) (b byte) {
-	return map[string]byte{
-		"r1": 0x01,
-		"r2": 0x02,
-	}[s]
+func TestRun(t *testing.T) {
+	mc, err := Assemble(`
+load r1 1
+addi r1 2
+store r1 0
+halt`)
+	if err != nil {
+		t.Fatalf("failed to assemble: %s", err)
+	}
+	memory := make([]byte, 256)
+	copy(memory[ProgramStart:], mc)
+	memory[1] = 5
+
+	result, err := Run(memory)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	want := Result{
+		PC:        0x11,
+		SP:        256,
+		Registers: []byte{0, 7, 0, 0, 0, 0, 0, 0, 0},
+		Steps:     4,
+		Reason:    Halted,
+		Counters:  Counters{Cycles: 8, Instructions: 4, Loads: 1, Stores: 1},
+	}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("got: %+v, wanted: %+v", result, want)
+	}
 }
 
-func mem(s string) (b byte) {
-	i, err := strconv.Atoi(s)
+func TestLoadOperandOrder(t *testing.T) {
+	// load r3 1; store r3 0; halt, written out by hand so it doesn't
+	// depend on the assembler agreeing with the interpreter
+	memory := make([]byte, 256)
+	copy(memory[ProgramStart:], []byte{Load, 0x03, 0x01, Store, 0x03, 0x00, Halt})
+	memory[1] = 9
+
+	if _, err := Run(memory); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if memory[0] != 9 {
+		t.Errorf("got %d, wanted 9", memory[0])
+	}
+}
+
+func TestRunRegisters(t *testing.T) {
+	mc, err := Assemble(`
+load r1 1
+load r2 2
+load r16 1
+add r16 r2
+add r16 r16
+store r16 0
+halt`)
+	if err != nil {
+		t.Fatalf("failed to assemble: %s", err)
+	}
+	memory := make([]byte, 256)
+	copy(memory[ProgramStart:], mc)
+	memory[1], memory[2] = 3, 4
+
+	// r16 doesn't exist by default
+	_, err = RunContext(context.Background(), append([]byte(nil), memory...), Options{})
+	if want := (ErrInvalidRegister{Reg: 16, PC: 14}); err != want {
+		t.Fatalf("got: %v, wanted: %v", err, want)
+	}
+
+	result, err := RunContext(context.Background(), memory, Options{Registers: MaxRegisters})
 	if err != nil {
-		panic(err)
-	}
-	return byte(i)
-}
-
-func imm(s string) (b byte) {
-	// for now, immediate values and memory addresses are both just ints
-	return mem(s)
-}
-
-// Assemble the given assembly code to machine code
-func assemble(asm string) []byte {
-	mc := []byte{}
-	asm = strings.TrimSpace(asm)
-	for _, line := range strings.Split(asm, "\n") {
-		parts := strings.Split(strings.TrimSpace(line), " ")
-		switch parts[0] {
-		case "load":
-			mc = append(mc, []byte{0x01, reg(parts[1]), mem(parts[2])}...)
-		case "store":
-			mc = append(mc, []byte{0x02, reg(parts[1]), mem(parts[2])}...)
-		case "add":
-			mc = append(mc, []byte{0x03, reg(parts[1]), reg(parts[2])}...)
-		case "sub":
-			mc = append(mc, []byte{0x04, reg(parts[1]), reg(parts[2])}...)
-		case "addi":
-			mc = append(mc, []byte{0x05, reg(parts[1]), imm(parts[2])}...)
-		case "subi":
-			mc = append(mc, []byte{0x06, reg(parts[1]), imm(parts[2])}...)
-		case "jump":
-			mc = append(mc, []byte{0x07, imm(parts[1])}...)
-		case "beqz":
-			mc = append(mc, []byte{0x08, reg(parts[1]), imm(parts[2])}...)
-		case "halt":
-			mc = append(mc, 0xff)
-		default:
-			panic("Invalid operation: " + parts[0])
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(result.Registers) != MaxRegisters+1 || result.Registers[16] != 14 || memory[0] != 14 {
+		t.Errorf("got: %+v, output: %d", result, memory[0])
+	}
+}
+
+func TestRunFaults(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		memory []byte
+		want   error
+		steps  int
+	}{
+		{
+			name:   "UnknownOpcode",
+			memory: []byte{0, 0, 0, 0, 0, 0, 0, 0, Addi, 0x01, 0x01, 0x42},
+			want:   ErrUnknownOpcode{Op: 0x42, PC: 11},
+			steps:  1,
+		},
+		{
+			name:   "FallOffTheEnd",
+			memory: []byte{0, 0, 0, 0, 0, 0, 0, 0, Addi, 0x01, 0x01},
+			want:   ErrPCOutOfBounds{PC: 11},
+			steps:  1,
+		},
+		{
+			name:   "TruncatedInstruction",
+			memory: []byte{0, 0, 0, 0, 0, 0, 0, 0, Load, 0x01},
+			want:   ErrPCOutOfBounds{PC: 8},
+		},
+		{
+			name:   "InvalidRegister",
+			memory: []byte{0, 0, 0, 0, 0, 0, 0, 0, Add, 0x01, 0x09},
+			want:   ErrInvalidRegister{Reg: 9, PC: 8},
+		},
+		{
+			name:   "NoRegisterZero",
+			memory: []byte{0, 0, 0, 0, 0, 0, 0, 0, Load, 0x00, 0x01},
+			want:   ErrInvalidRegister{Reg: 0, PC: 8},
+		},
+		{
+			name:   "DivideByZero",
+			memory: []byte{0, 0, 0, 0, 0, 0, 0, 0, Div, 0x01, 0x02},
+			want:   ErrDivideByZero{PC: 8},
+		},
+		{
+			name:   "ModByZero",
+			memory: []byte{0, 0, 0, 0, 0, 0, 0, 0, Mod, 0x01, 0x02},
+			want:   ErrDivideByZero{PC: 8},
+		},
+		{
+			name:   "StackUnderflow",
+			memory: []byte{0, 0, 0, 0, 0, 0, 0, 0, Ret},
+			want:   ErrStackUnderflow{SP: 9, PC: 8},
+		},
+		{
+			name:   "StoreOutOfBounds",
+			memory: []byte{0, 0, 0, 0, 0, 0, 0, 0, Store, 0x01, 0x20},
+			want:   ErrAddressOutOfBounds{Addr: 0x20, PC: 8},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := Run(test.memory)
+			if err != test.want {
+				t.Fatalf("got error: %v, wanted: %v", err, test.want)
+			}
+			if result.Reason != Faulted {
+				t.Errorf("got reason: %s, wanted: %s", result.Reason, Faulted)
+			}
+			if result.Steps != test.steps {
+				t.Errorf("got steps: %d, wanted: %d", result.Steps, test.steps)
+			}
+		})
+	}
+}
+
+// TestRunInvalidRegisters checks every register operand of every
+// instruction is validated, so a bad register byte faults rather than
+// panicking
+func TestRunInvalidRegisters(t *testing.T) {
+	for _, in := range instructions {
+		for i, kind := range in.operands {
+			if kind != regOperand {
+				continue
+			}
+			memory := make([]byte, 256)
+			memory[ProgramStart] = in.opcode
+			for j := range in.operands {
+				memory[ProgramStart+1+j] = 0x01
+			}
+			memory[ProgramStart+1+i] = 0xff
+
+			_, err := Run(memory)
+			if want := (ErrInvalidRegister{Reg: 0xff, PC: ProgramStart}); err != want {
+				t.Errorf("%s operand %d: got %v, wanted %v", in.mnemonic, i+1, err, want)
+			}
+		}
+	}
+}
+
+func TestRunInvalidOptions(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		opts Options
+	}{
+		{"Registers", Options{Registers: MaxRegisters + 1}},
+		{"StackSize", Options{StackSize: -1}},
+		{"Profile", Options{Profile: Profile{MemorySize: 256, AddressWidth: 3}}},
+		{"Cache", Options{Caches: []CacheConfig{{Size: 10, LineSize: 4, Ways: 1}}}},
+		{"Entry", Options{Entry: 256}},
+		{"InterruptVector", Options{InterruptVector: 256}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			memory := make([]byte, 256)
+			memory[ProgramStart] = Halt
+			if _, err := RunContext(context.Background(), memory, test.opts); !errors.Is(err, ErrInvalidOptions) {
+				t.Errorf("got %v, wanted an ErrInvalidOptions", err)
+			}
+			if _, _, err := RunPipelined(context.Background(), memory, PipelineOptions{Options: test.opts}); !errors.Is(err, ErrInvalidOptions) {
+				t.Errorf("pipeline got %v, wanted an ErrInvalidOptions", err)
+			}
+		})
+	}
+}
+
+func TestRunBudget(t *testing.T) {
+	// jump to itself forever
+	memory := make([]byte, 256)
+	copy(memory[ProgramStart:], []byte{Jump, ProgramStart})
+
+	result, err := RunContext(context.Background(), memory, Options{MaxSteps: 100})
+
+	want := ErrBudgetExhausted{PC: ProgramStart, Steps: 100}
+	if err != want {
+		t.Fatalf("got error: %v, wanted: %v", err, want)
+	}
+	if result.Reason != BudgetExhausted || result.Steps != 100 {
+		t.Errorf("got: %+v", result)
+	}
+}
+
+func TestRunCancelled(t *testing.T) {
+	memory := make([]byte, 256)
+	copy(memory[ProgramStart:], []byte{Jump, ProgramStart})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	result, err := RunContext(ctx, memory, Options{})
+
+	var budgetErr ErrBudgetExhausted
+	if !errors.As(err, &budgetErr) {
+		t.Fatalf("expected ErrBudgetExhausted, got: %v", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the context's error to be wrapped, got: %v", err)
+	}
+	if budgetErr.Steps != result.Steps || budgetErr.PC != ProgramStart {
+		t.Errorf("got: %+v, result: %+v", budgetErr, result)
+	}
+}
+
+func TestRunStackOverflow(t *testing.T) {
+	mc, err := Assemble(`
+forever:
+	push r1
+	jump forever`)
+	if err != nil {
+		t.Fatalf("failed to assemble: %s", err)
+	}
+	memory := make([]byte, 256)
+	copy(memory[ProgramStart:], mc)
+
+	result, err := RunContext(context.Background(), memory, Options{StackSize: 4})
+	if want := (ErrStackOverflow{SP: 252, PC: 8}); err != want {
+		t.Fatalf("got: %v, wanted: %v", err, want)
+	}
+	// Four pushes and jumps succeeded, and the program was untouched
+	if result.Steps != 8 || memory[ProgramStart] != Push {
+		t.Errorf("got: %+v", result)
+	}
+}
+
+func TestFlags(t *testing.T) {
+	for _, test := range []struct {
+		op    string
+		a, b  byte
+		res   byte
+		flags Flags
+	}{
+		{"add", 1, 2, 3, 0},
+		{"add", 255, 1, 0, FlagZ | FlagC},
+		{"add", 127, 1, 128, FlagN | FlagV},
+		{"add", 128, 128, 0, FlagZ | FlagC | FlagV},
+		{"add", 255, 255, 254, FlagN | FlagC},
+		{"sub", 3, 2, 1, 0},
+		{"sub", 2, 2, 0, FlagZ},
+		{"sub", 2, 3, 255, FlagN | FlagC},
+		{"sub", 128, 1, 127, FlagV},
+		{"sub", 127, 255, 128, FlagN | FlagC | FlagV},
+	} {
+		f := add
+		if test.op == "sub" {
+			f = sub
+		}
+
+		res, flags := f(test.a, test.b)
+		if res != test.res || flags != test.flags {
+			t.Errorf("%s %d %d: got %d %s, wanted %d %s", test.op, test.a, test.b, res, flags, test.res, test.flags)
 		}
 	}
-	return mc
 }